@@ -0,0 +1,132 @@
+package httpauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestAPIAuthorizer(t *testing.T) Authorizer {
+	auth := newTestAuthorizer(t)
+	auth.SetAPIMode(true)
+	return auth
+}
+
+// checkAPIError makes sure a response is a JSON error with the given status and
+// code, and that no cookies were set.
+func checkAPIError(t *testing.T, rw *httptest.ResponseRecorder, status int, code string) {
+	if rw.Code != status {
+		t.Errorf("Wrong status code: expected %v, got %v", status, rw.Code)
+	}
+	var body struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid JSON error body: %v", err)
+	}
+	if body.Error.Code != code {
+		t.Errorf("Wrong error code: expected %v, got %v", code, body.Error.Code)
+	}
+	if body.Error.Message == "" {
+		t.Error("Error message missing")
+	}
+	if cookies := rw.Header().Get("Set-Cookie"); cookies != "" {
+		t.Errorf("Cookie set in API mode: %v", cookies)
+	}
+}
+
+func TestAPILogin(t *testing.T) {
+	auth := newTestAPIAuthorizer(t)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, "user", "wrongpassword", "/"); err == nil {
+		t.Fatal("Login: Logged in with incorrect password.")
+	}
+	checkAPIError(t, rw, http.StatusUnauthorized, CodeBadCredentials)
+
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, req, "user", "password", "/"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if loc := rw.Header().Get("Location"); loc != "" {
+		t.Fatalf("Login: redirected to %v in API mode", loc)
+	}
+
+	req = newTestRequest("POST", rw.Result().Cookies())
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, req, "user", "password", "/"); err == nil {
+		t.Fatal("Login: logged in twice")
+	}
+	checkAPIError(t, rw, http.StatusConflict, CodeAlreadyAuthenticated)
+}
+
+func TestAPIRegister(t *testing.T) {
+	auth := newTestAPIAuthorizer(t)
+	req, _ := http.NewRequest("POST", "/register", nil)
+
+	rw := httptest.NewRecorder()
+	if err := auth.Register(rw, req, UserData{Username: "user", Email: "e@example.com"}, "password"); err == nil {
+		t.Fatal("Register: User registered with duplicate name")
+	}
+	checkAPIError(t, rw, http.StatusConflict, CodeUserExists)
+
+	rw = httptest.NewRecorder()
+	if err := auth.Register(rw, req, UserData{Username: "new"}, "password"); err == nil {
+		t.Fatal("Register: User registered without email")
+	}
+	checkAPIError(t, rw, http.StatusUnprocessableEntity, CodeInvalidRequest)
+}
+
+func TestAPIAuthorize(t *testing.T) {
+	auth := newTestAPIAuthorizer(t)
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest("GET", nil)
+	req.Header.Set("Accept", "text/html")
+	if err := auth.Authorize(rw, req, true); err == nil {
+		t.Fatal("Authorize: no error on non authorized request")
+	}
+	checkAPIError(t, rw, http.StatusUnauthorized, CodeNotLoggedIn)
+
+	var called bool
+	h := auth.RequireRole("admin", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	rw = httptest.NewRecorder()
+	req = newTestRequest("GET", loginCookies(t, auth, "user"))
+	req.Header.Set("Accept", "text/html")
+	h.ServeHTTP(rw, req)
+	if called {
+		t.Fatal("RequireRole: handler called for user")
+	}
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("RequireRole: wrong content type %v", ct)
+	}
+	checkAPIError(t, rw, http.StatusForbidden, CodeInsufficientRole)
+}
+
+func TestAPIBackendError(t *testing.T) {
+	auth := newTestAPIAuthorizer(t)
+	auth.backend = brokenBackend{auth.backend}
+	var logs bytes.Buffer
+	auth.SetLogger(log.New(&logs, "", 0))
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, "user", "password", "/"); !errors.Is(err, errTestBackend) {
+		t.Fatalf("Login: expected backend error, got %v", err)
+	}
+	if strings.Contains(rw.Body.String(), errTestBackend.Error()) {
+		t.Errorf("Login: backend error sent to client: %v", rw.Body.String())
+	}
+	checkAPIError(t, rw, http.StatusInternalServerError, CodeBackendError)
+	if !strings.Contains(logs.String(), errTestBackend.Error()) {
+		t.Errorf("Login: backend error not logged: %q", logs.String())
+	}
+}
@@ -1,7 +1,8 @@
 // Package httpauth implements cookie/session based authentication and
 // authorization. Intended for use with the net/http or github.com/gorilla/mux
 // packages, but may work with github.com/codegangsta/martini as well.
-// Credentials are stored as a username + password hash, computed with bcrypt.
+// Credentials are stored as a username + password hash, computed with bcrypt by
+// default, or with argon2id or scrypt.
 //
 // Three user storage systems are currently implemented: file based
 // (encoding/gob), sql databases (database/sql), and MongoDB databases.
@@ -11,27 +12,24 @@
 //
 // Users can be redirected to the page that triggered an authentication error.
 //
+// Optionally, users can be required to verify their email address or to log in
+// with a second factor, and locked out after too many failed logins.
+//
 // Messages describing the reason a user could not authenticate are saved in a
 // cookie, and can be accessed with the Messages function.
+// Alternatively, an Authorizer in API mode writes them to the response as JSON
+// errors; see SetAPIMode.
 //
 // Example source can be found at
 // https://github.com/apexskier/httpauth/blob/master/examples/server.go
 package httpauth
 
 import (
-	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
-	"golang.org/x/crypto/bcrypt"
-)
-
-// ErrDeleteNull is returned by DeleteUser when that user didn't exist at the
-// time of call.
-// ErrMissingUser is returned by Users when a user is not found.
-var (
-	ErrDeleteNull  = mkerror("deleting non-existant user")
-	ErrMissingUser = mkerror("can't find user")
 )
 
 // Role represents an interal role. Roles are essentially a string mapped to an
@@ -42,20 +40,71 @@ type Role int
 // and role as well as a hash of their password. When creating
 // users, you should not specify a hash; it will be generated in the Register
 // and Update functions.
+//
+// Role is the user's primary role and Roles lists all roles they hold,
+// including Role. Users stored before Roles existed only have Role; backends
+// fill Roles in from it when loading them. Users also hold the roles of the
+// groups listed in Groups; see AddGroup. Authorization looks at all of these.
+//
+// EmailVerified is set once the user followed a verification link; see
+// VerifyEmail.
+//
+// TOTPSecret and TOTPEnabled hold the user's second factor; see EnrollTOTP.
+// TOTPLastStep is the time step of the last code accepted, which can't be
+// used again. SecondFactorFailures counts wrong codes in a row, the last of
+// them at the Unix time SecondFactorFailedAt. RecoveryCodes holds hashes of
+// their unused recovery codes; see GenerateRecoveryCodes. LoginNonce holds a
+// hash identifying their outstanding login link; see SendLoginLink.
+// SessionGeneration is incremented to end all their sessions; see LogoutAll.
+// Attributes are free-form data about the user for policy rules to look at;
+// see Can.
 type UserData struct {
-	Username string `bson:"Username"`
-	Email    string `bson:"Email"`
-	Hash     []byte `bson:"Hash"`
-	Role     string `bson:"Role"`
+	Username             string            `bson:"Username"`
+	Email                string            `bson:"Email"`
+	EmailVerified        bool              `bson:"EmailVerified"`
+	Hash                 []byte            `bson:"Hash"`
+	Role                 string            `bson:"Role"`
+	Roles                []string          `bson:"Roles"`
+	Groups               []string          `bson:"Groups"`
+	TOTPSecret           string            `bson:"TOTPSecret"`
+	TOTPEnabled          bool              `bson:"TOTPEnabled"`
+	TOTPLastStep         int64             `bson:"TOTPLastStep"`
+	RecoveryCodes        []string          `bson:"RecoveryCodes"`
+	LoginNonce           string            `bson:"LoginNonce"`
+	SessionGeneration    int               `bson:"SessionGeneration"`
+	Attributes           map[string]string `bson:"Attributes"`
+	SecondFactorFailures int               `bson:"SecondFactorFailures"`
+	SecondFactorFailedAt int64             `bson:"SecondFactorFailedAt"`
 }
 
 // Authorizer structures contain the store of user session cookies a reference
 // to a backend storage system.
 type Authorizer struct {
-	cookiejar   *sessions.CookieStore
-	backend     AuthBackend
-	defaultRole string
-	roles       map[string]Role
+	cookiejar     *sessions.CookieStore // holds "auth" cookie sessions
+	messageStore  *sessions.CookieStore
+	redirectStore *sessions.CookieStore
+	cookies       CookieOptions
+	backend       AuthBackend
+	roles         *roleSet
+	loginURL      string
+	apiMode       bool
+	hasher        PasswordHasher
+	onRehash      func(RehashEvent)
+	lockout       LockoutPolicy
+	failures      FailureStore
+	tokens        []securecookie.Codec
+	email         EmailConfig
+	authStore     sessions.Store // holds "auth" sessions; see SetSessionStore
+	sessionStore  SessionStore
+	timeouts      SessionTimeouts
+	roleTimeouts  map[string]SessionTimeouts
+	logger        Logger
+	hooks         []func(Event)
+	catalog       MessageCatalog
+	redirectHosts []string
+	csrf          CSRFOptions
+	policy        []compiledRule
+	locks         *keyedMutex // serializes updates of failure records and second factor checks
 }
 
 // The AuthBackend interface defines a set of methods an AuthBackend must
@@ -68,81 +117,169 @@ type AuthBackend interface {
 	Close()
 }
 
-// Helper function to add a user directed message to a message queue.
+// Helper function to add a user directed message to a message queue. Does
+// nothing in API mode.
 func (a Authorizer) addMessage(rw http.ResponseWriter, req *http.Request, message string) {
-	messageSession, _ := a.cookiejar.Get(req, "messages")
+	if a.apiMode {
+		return
+	}
+	messageSession, _ := a.messageSession(req)
 	defer messageSession.Save(req, rw)
 	messageSession.AddFlash(message)
 }
 
 // Helper function to save a redirect to the page a user tried to visit before
-// logging in.
+// logging in. The query string is kept for GET requests. Does nothing in API
+// mode.
 func (a Authorizer) goBack(rw http.ResponseWriter, req *http.Request) {
-	redirectSession, _ := a.cookiejar.Get(req, "redirects")
+	if a.apiMode {
+		return
+	}
+	redirectSession, _ := a.redirectSession(req)
 	defer redirectSession.Save(req, rw)
 	redirectSession.Flashes()
-	redirectSession.AddFlash(req.URL.Path)
+	if req.Method == "GET" {
+		redirectSession.AddFlash(req.URL.RequestURI())
+	} else {
+		redirectSession.AddFlash(req.URL.EscapedPath())
+	}
+}
+
+// Helper function to look up the user of a session, reusing the one stored in
+// the request's context if it is from the same session generation.
+func (a Authorizer) loadUser(req *http.Request, session *sessions.Session) (UserData, error) {
+	username, _ := session.Values["username"].(string)
+	generation, _ := session.Values["generation"].(int)
+	if user, ok := UserFromContext(req.Context()); ok && user.Username == username && user.SessionGeneration == generation {
+		return user, nil
+	}
+	return a.backend.User(username)
 }
 
-func mkerror(msg string) error {
-	return errors.New("httpauth: " + msg)
+// KeyPair is a key for signing cookies and tokens, with an optional key for
+// encrypting them. Hash should be 32 or 64 random bytes. Block must be 16, 24
+// or 32 random bytes to select AES-128, AES-192 or AES-256, or nil to only
+// sign.
+type KeyPair struct {
+	Hash  []byte
+	Block []byte
 }
 
 // NewAuthorizer returns a new Authorizer given an AuthBackend, a cookie store
 // key, a default user role, and a map of roles. If the key changes, logged in
-// users will need to reauthenticate.
+// users will need to reauthenticate and links in emails stop working; use
+// NewAuthorizerWithKeys to rotate keys without that. For more settings, see
+// NewAuthorizerWithOptions.
 //
 // Roles are a map of string to httpauth.Role values (integers). Higher Role values
 // have more access.
 //
 // Example roles:
 //
-//     var roles map[string]httpauth.Role
-//     roles["user"] = 2
-//     roles["admin"] = 4
-//     roles["moderator"] = 3
+//	var roles map[string]httpauth.Role
+//	roles["user"] = 2
+//	roles["admin"] = 4
+//	roles["moderator"] = 3
+//
+// If the backend is a RoleBackend, roles it already stores take precedence,
+// and the others are added to it. Roles can be changed later with AddRole,
+// UpdateRoleLevel, RenameRole and DeleteRole.
 func NewAuthorizer(backend AuthBackend, key []byte, defaultRole string, roles map[string]Role) (Authorizer, error) {
-	var a Authorizer
-	a.cookiejar = sessions.NewCookieStore([]byte(key))
-	a.backend = backend
-	a.roles = roles
-	a.defaultRole = defaultRole
-	if _, ok := roles[defaultRole]; !ok {
-		return a, mkerror("httpauth: defaultRole missing")
-	}
-	return a, nil
+	return NewAuthorizerWithOptions(backend, WithKey(key), WithRoles(defaultRole, roles))
+}
+
+// NewAuthorizerWithKeys is like NewAuthorizer, but takes a list of key pairs
+// so that keys can be rotated. Cookies and tokens are written with the first
+// pair, and read with any of them. To rotate, add a new pair at the front and
+// remove the last one once everything made with it has expired.
+func NewAuthorizerWithKeys(backend AuthBackend, keys []KeyPair, defaultRole string, roles map[string]Role) (Authorizer, error) {
+	return NewAuthorizerWithOptions(backend, WithKeys(keys...), WithRoles(defaultRole, roles))
 }
 
 // Login logs a user in. They will be redirected to dest or to the last
 // location an authorization redirect was triggered (if found) on success
 // if the request was a GET. All other requests  types are not redirected.
 // A message will be added to the session on failure with the reason.
+//
+// To prevent open redirects, only paths on the same site are followed, plus
+// absolute URLs on hosts allowed with SetRedirectHosts. A saved location
+// that isn't safe is replaced by dest, and an unsafe dest by "/".
+//
+// If a lockout policy is set (see SetLockout), failed attempts are counted and
+// a *LockoutError is returned while the account or client IP is locked.
+//
+// If verified email addresses are required (see EmailConfig), users who
+// haven't verified theirs get ErrEmailNotVerified.
+//
+// If the user has two factor authentication enabled, ErrSecondFactorRequired
+// is returned instead of logging them in, and the login has to be finished
+// with VerifySecondFactor.
+//
+// If the user's password hash was made with an outdated algorithm or
+// parameters it is replaced with one from the current PasswordHasher.
+//
+// Logging in starts a new session, with a new session ID if a SessionStore is
+// used, so that a session cookie planted beforehand can't be used to share
+// the login.
+//
+// In API mode no redirects are made and failures are written as JSON errors.
 func (a Authorizer) Login(rw http.ResponseWriter, req *http.Request, u string, p string, dest string) error {
-	session, _ := a.cookiejar.Get(req, "auth")
+	session, _ := a.authSession(req)
 	if session.Values["username"] != nil {
-		return mkerror("already authenticated")
+		a.apiError(rw, http.StatusConflict, CodeAlreadyAuthenticated, "Already logged in.")
+		return ErrAlreadyAuthenticated
 	}
-	if user, err := a.backend.User(u); err == nil {
-		verify := bcrypt.CompareHashAndPassword(user.Hash, []byte(p))
-		if verify != nil {
-			a.addMessage(rw, req, "Invalid username or password.")
-			return mkerror("password doesn't match")
-		}
-	} else {
-		a.addMessage(rw, req, "Invalid username or password.")
-		return mkerror("user not found")
+	if err := a.checkLockout(req, u); err != nil {
+		a.reportLockout(rw, req, err)
+		return err
 	}
-	session.Values["username"] = u
+	user, err := a.backend.User(u)
+	if err == ErrMissingUser {
+		a.recordFailure(req, u, ErrUserNotFound)
+		a.fail(rw, req, http.StatusUnauthorized, CodeBadCredentials, "Invalid username or password.")
+		return ErrUserNotFound
+	} else if err != nil {
+		a.backendFailure(rw, err)
+		return backendError(err)
+	}
+	if ok, _ := a.verifyPassword(user.Hash, p); !ok {
+		a.recordFailure(req, u, ErrBadCredentials)
+		a.fail(rw, req, http.StatusUnauthorized, CodeBadCredentials, "Invalid username or password.")
+		return ErrBadCredentials
+	}
+	if a.hasher.NeedsRehash(user.Hash) {
+		user = a.rehash(user, p)
+	}
+	if a.email.RequireVerifiedEmail && !user.EmailVerified {
+		a.fail(rw, req, http.StatusForbidden, CodeEmailNotVerified, "Verify your email address to log in.")
+		return ErrEmailNotVerified
+	}
+	if user.TOTPEnabled {
+		a.startPendingLogin(rw, req, session, u)
+		a.apiError(rw, http.StatusUnauthorized, CodeSecondFactorRequired, "Enter the code from your authenticator app.")
+		return ErrSecondFactorRequired
+	}
+	a.resetFailures(u)
+	a.finishLogin(rw, req, session, user, dest)
+	return nil
+}
+
+// Helper function to log a user in once their credentials have been checked,
+// redirecting them like Login describes.
+func (a Authorizer) finishLogin(rw http.ResponseWriter, req *http.Request, session *sessions.Session, user UserData, dest string) {
+	a.startSession(session, user)
 	session.Save(req, rw)
+	a.emit(req, Event{Type: EventLogin, Username: user.Username})
 
-	if dest != "" {
-		redirectSession, _ := a.cookiejar.Get(req, "redirects")
+	if dest != "" && !a.apiMode {
+		var saved string
+		redirectSession, _ := a.redirectSession(req)
 		if flashes := redirectSession.Flashes(); len(flashes) > 0 {
-			dest = flashes[0].(string)
+			saved, _ = flashes[0].(string)
+			redirectSession.Save(req, rw)
 		}
-		http.Redirect(rw, req, dest, http.StatusSeeOther)
+		http.Redirect(rw, req, a.redirectTarget(saved, dest), http.StatusSeeOther)
 	}
-	return nil
 }
 
 // Register and save a new user. Returns an error and adds a message if the
@@ -150,78 +287,105 @@ func (a Authorizer) Login(rw http.ResponseWriter, req *http.Request, u string, p
 //
 // Pass in a instance of UserData with at least a username and email specified. If no role
 // is given, the default one is used.
+//
+// New users start with an unverified email address. If a Mailer is configured
+// they are sent a verification link; if that fails, the user is still saved
+// and the error is returned.
 func (a Authorizer) Register(rw http.ResponseWriter, req *http.Request, user UserData, password string) error {
 	if user.Username == "" {
-		return mkerror("no username given")
+		a.apiError(rw, http.StatusUnprocessableEntity, CodeInvalidRequest, "No username given.")
+		return fmt.Errorf("%w: no username given", ErrInvalidUser)
 	}
 	if user.Email == "" {
-		return mkerror("no email given")
+		a.apiError(rw, http.StatusUnprocessableEntity, CodeInvalidRequest, "No email given.")
+		return fmt.Errorf("%w: no email given", ErrInvalidUser)
 	}
 	if user.Hash != nil {
-		return mkerror("hash will be overwritten")
+		a.apiError(rw, http.StatusUnprocessableEntity, CodeInvalidRequest, "Hash will be overwritten.")
+		return fmt.Errorf("%w: hash will be overwritten", ErrInvalidUser)
 	}
 	if password == "" {
-		return mkerror("no password given")
+		a.apiError(rw, http.StatusUnprocessableEntity, CodeInvalidRequest, "No password given.")
+		return fmt.Errorf("%w: no password given", ErrInvalidUser)
 	}
 
 	// Validate username
 	_, err := a.backend.User(user.Username)
 	if err == nil {
-		a.addMessage(rw, req, "Username has been taken.")
-		return mkerror("user already exists")
+		a.fail(rw, req, http.StatusConflict, CodeUserExists, "Username has been taken.")
+		return ErrUserExists
 	} else if err != ErrMissingUser {
-		if err != nil {
-			return mkerror(err.Error())
-		}
-		return nil
+		a.backendFailure(rw, err)
+		return backendError(err)
 	}
 
 	// Generate and save hash
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := a.hasher.Hash(password)
 	if err != nil {
-		return mkerror("couldn't save password: " + err.Error())
+		a.apiError(rw, http.StatusInternalServerError, CodeBackendError, "Couldn't save password.")
+		return fmt.Errorf("httpauth: couldn't save password: %w", err)
 	}
 	user.Hash = hash
 
-	// Validate role
-	if user.Role == "" {
-		user.Role = a.defaultRole
-	} else {
-		if _, ok := a.roles[user.Role]; !ok {
-			return mkerror("non-existant role")
+	// Validate roles and groups
+	if user.Role == "" && len(user.Roles) == 0 {
+		user.Role = a.roles.defaultName()
+	}
+	migrateRoles(&user)
+	for _, role := range user.Roles {
+		if _, ok := a.roles.level(role); !ok {
+			a.apiError(rw, http.StatusUnprocessableEntity, CodeRoleNotFound, "Role doesn't exist.")
+			return fmt.Errorf("%w: %q", ErrRoleNotFound, role)
 		}
 	}
+	if err := a.roles.checkGroups(user.Groups); err != nil {
+		a.apiError(rw, http.StatusUnprocessableEntity, CodeGroupNotFound, "Group doesn't exist.")
+		return err
+	}
 
+	user.EmailVerified = false
 	err = a.backend.SaveUser(user)
 	if err != nil {
-		a.addMessage(rw, req, err.Error())
-		return mkerror(err.Error())
+		a.logf("backend error: %v", err)
+		a.fail(rw, req, http.StatusInternalServerError, CodeBackendError, "Internal error.")
+		return backendError(err)
+	}
+	a.emit(req, Event{Type: EventRegister, Username: user.Username})
+	if a.email.Mailer != nil {
+		return a.sendVerificationEmail(user)
 	}
 	return nil
 }
 
 // Update changes data for an existing user. Needs thought...
+//
+// Changing the password ends the user's other sessions, and moves the current
+// one to a new session ID. A changed email address has to be verified again;
+// if a Mailer is configured, a verification link is sent to it.
 func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, p string, e string) error {
 	var (
 		hash  []byte
 		email string
 	)
-	authSession, err := a.cookiejar.Get(req, "auth")
+	authSession, err := a.authSession(req)
 	username, ok := authSession.Values["username"].(string)
 	if !ok {
-		return mkerror("not logged in")
+		a.apiError(rw, http.StatusUnauthorized, CodeNotLoggedIn, "Log in to do that.")
+		return ErrNotLoggedIn
 	}
 	user, err := a.backend.User(username)
 	if err == ErrMissingUser {
-		a.addMessage(rw, req, "User doesn't exist.")
-		return mkerror("user doesn't exists")
+		a.fail(rw, req, http.StatusNotFound, CodeUserNotFound, "User doesn't exist.")
+		return ErrUserNotFound
 	} else if err != nil {
-		return mkerror(err.Error())
+		a.backendFailure(rw, err)
+		return backendError(err)
 	}
 	if p != "" {
-		hash, err = bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+		hash, err = a.hasher.Hash(p)
 		if err != nil {
-			return mkerror("couldn't save password: " + err.Error())
+			a.apiError(rw, http.StatusInternalServerError, CodeBackendError, "Couldn't save password.")
+			return fmt.Errorf("httpauth: couldn't save password: %w", err)
 		}
 	} else {
 		hash = user.Hash
@@ -232,113 +396,216 @@ func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, p string,
 		email = user.Email
 	}
 
-	newuser := UserData{username, email, hash, user.Role}
+	newuser := user
+	newuser.Email = email
+	newuser.Hash = hash
+	if email != user.Email {
+		newuser.EmailVerified = false
+	}
+	if p != "" {
+		newuser.SessionGeneration++
+	}
 
 	err = a.backend.SaveUser(newuser)
 	if err != nil {
-		a.addMessage(rw, req, err.Error())
+		a.logf("backend error: %v", err)
+		a.fail(rw, req, http.StatusInternalServerError, CodeBackendError, "Internal error.")
+		return backendError(err)
+	}
+	if p != "" {
+		a.rotateSessions(rw, req, newuser)
+	}
+	if email != user.Email && a.email.Mailer != nil {
+		return a.sendVerificationEmail(newuser)
 	}
 	return nil
 }
 
+// ChangeRole gives username the given role, replacing all roles they held.
+// The user's sessions are ended, so they log in again with the new role; if
+// the request is theirs, its session is moved to a new session ID instead.
+// Returns ErrUserNotFound, or ErrRoleNotFound for roles the Authorizer doesn't
+// know.
+func (a Authorizer) ChangeRole(rw http.ResponseWriter, req *http.Request, username string, role string) error {
+	return a.SetUserRoles(rw, req, username, role)
+}
+
+// SetUserRoles gives username the given roles, replacing the ones they held.
+// The first becomes their primary Role. Sessions are ended as by ChangeRole.
+func (a Authorizer) SetUserRoles(rw http.ResponseWriter, req *http.Request, username string, roles ...string) error {
+	for _, role := range roles {
+		if _, ok := a.roles.level(role); !ok {
+			return fmt.Errorf("%w: %q", ErrRoleNotFound, role)
+		}
+	}
+	return a.changeUser(rw, req, username, func(user *UserData) {
+		user.Role = ""
+		user.Roles = append([]string(nil), roles...)
+		migrateRoles(user)
+	})
+}
+
+// changeUser applies change to username and saves them, ending their
+// sessions.
+func (a Authorizer) changeUser(rw http.ResponseWriter, req *http.Request, username string, change func(user *UserData)) error {
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
+		return backendError(err)
+	}
+	change(&user)
+	user.SessionGeneration++
+	if err := a.backend.SaveUser(user); err != nil {
+		return backendError(err)
+	}
+	a.rotateSessions(rw, req, user)
+	return nil
+}
+
 // Authorize checks if a user is logged in and returns an error on failed
 // authentication. If redirectWithMessage is set, the page being authorized
 // will be saved and a "Login to do that." message will be saved to the
 // messages list. The next time the user logs in, they will be redirected back
 // to the saved page.
+//
+// Sessions ended by LogoutAll are rejected with ErrSessionRevoked, and ones
+// that timed out (see SetSessionTimeouts) with a *SessionExpiredError.
 func (a Authorizer) Authorize(rw http.ResponseWriter, req *http.Request, redirectWithMessage bool) error {
-	authSession, err := a.cookiejar.Get(req, "auth")
+	_, _, err := a.authorize(rw, req, redirectWithMessage)
+	return err
+}
+
+// authorize does the work of Authorize. It returns the logged in user, and a
+// copy of req carrying them in its context once every check has passed; on
+// failure the copy carries no user.
+func (a Authorizer) authorize(rw http.ResponseWriter, req *http.Request, redirectWithMessage bool) (*http.Request, UserData, error) {
+	var user UserData
+	authSession, err := a.authSession(req)
 	if err != nil {
 		if redirectWithMessage {
 			a.goBack(rw, req)
+			a.apiError(rw, http.StatusUnauthorized, CodeNotLoggedIn, "Log in to do that.")
 		}
-		return mkerror("new authorization session")
-	}
-	/*if authSession.IsNew {
-	    if redirectWithMessage {
-	        a.goBack(rw, req)
-	        a.addMessage(rw, req, "Log in to do that.")
-	    }
-	    return mkerror("no session existed")
-	}*/
-	username := authSession.Values["username"]
-	if !authSession.IsNew && username != nil {
-		_, err := a.backend.User(username.(string))
-		if err == ErrMissingUser {
-			authSession.Options.MaxAge = -1 // kill the cookie
-			authSession.Save(req, rw)
-			if redirectWithMessage {
-				a.goBack(rw, req)
-				a.addMessage(rw, req, "Log in to do that.")
-			}
-			return mkerror("user not found")
-		} else if err != nil {
-			return mkerror(err.Error())
+		return withoutUser(req), user, ErrNotLoggedIn
+	}
+	if _, ok := authSession.Values["username"].(string); !ok {
+		if redirectWithMessage {
+			a.goBack(rw, req)
+			a.fail(rw, req, http.StatusUnauthorized, CodeNotLoggedIn, "Log in to do that.")
 		}
+		return withoutUser(req), user, ErrNotLoggedIn
 	}
-	if username == nil {
+	user, err = a.loadUser(req, authSession)
+	if err == ErrMissingUser {
+		authSession.Options.MaxAge = -1 // kill the cookie
+		authSession.Save(req, rw)
 		if redirectWithMessage {
 			a.goBack(rw, req)
-			a.addMessage(rw, req, "Log in to do that.")
+			a.fail(rw, req, http.StatusUnauthorized, CodeNotLoggedIn, "Log in to do that.")
+		}
+		return withoutUser(req), UserData{}, ErrUserNotFound
+	} else if err != nil {
+		if redirectWithMessage {
+			a.backendFailure(rw, err)
 		}
-		return mkerror("user not logged in")
+		return withoutUser(req), UserData{}, backendError(err)
 	}
-	return nil
+	if generation, _ := authSession.Values["generation"].(int); generation != user.SessionGeneration {
+		authSession.Options.MaxAge = -1
+		authSession.Save(req, rw)
+		if redirectWithMessage {
+			a.goBack(rw, req)
+			a.fail(rw, req, http.StatusUnauthorized, CodeNotLoggedIn, "Log in to do that.")
+		}
+		return withoutUser(req), UserData{}, ErrSessionRevoked
+	}
+	if err := a.checkTimeouts(rw, req, authSession, user); err != nil {
+		authSession.Options.MaxAge = -1
+		authSession.Save(req, rw)
+		if redirectWithMessage {
+			a.goBack(rw, req)
+			a.fail(rw, req, http.StatusUnauthorized, CodeSessionExpired, "Your session expired. Log in again.")
+		}
+		return withoutUser(req), UserData{}, err
+	}
+	return withUser(req, user), user, nil
 }
 
-// AuthorizeRole runs Authorize on a user, then makes sure their role is at
-// least as high as the specified one, failing if not.
+// AuthorizeRole runs Authorize on a user, then makes sure the highest of
+// their roles, held directly or through a group, is at least as high as the
+// specified one, failing if not.
 func (a Authorizer) AuthorizeRole(rw http.ResponseWriter, req *http.Request, role string, redirectWithMessage bool) error {
-	r, ok := a.roles[role]
+	_, err := a.authorizeRole(rw, req, role, redirectWithMessage)
+	return err
+}
+
+// authorizeRole does the work of AuthorizeRole, returning a copy of req like
+// authorize does.
+func (a Authorizer) authorizeRole(rw http.ResponseWriter, req *http.Request, role string, redirectWithMessage bool) (*http.Request, error) {
+	r, ok := a.roles.level(role)
 	if !ok {
-		return mkerror("role not found")
+		if redirectWithMessage {
+			a.apiError(rw, http.StatusInternalServerError, CodeRoleNotFound, "Role doesn't exist.")
+		}
+		return withoutUser(req), fmt.Errorf("%w: %q", ErrRoleNotFound, role)
 	}
-	if err := a.Authorize(rw, req, redirectWithMessage); err != nil {
-		return mkerror(err.Error())
+	authed, user, err := a.authorize(rw, req, redirectWithMessage)
+	if err != nil {
+		return authed, err
 	}
-	authSession, _ := a.cookiejar.Get(req, "auth") // should I check err? I've already checked in call to Authorize
-	username := authSession.Values["username"]
-	if user, err := a.backend.User(username.(string)); err == nil {
-		if a.roles[user.Role] >= r {
-			return nil
-		}
-		a.addMessage(rw, req, "You don't have sufficient privileges.")
-		return mkerror("user doesn't have high enough role")
+	if a.roles.maxLevel(a.roles.userRoles(user)) >= r {
+		return authed, nil
+	}
+	a.addMessage(rw, req, a.text(CodeInsufficientRole, "You don't have sufficient privileges."))
+	if redirectWithMessage {
+		a.apiError(rw, http.StatusForbidden, CodeInsufficientRole, "You don't have sufficient privileges.")
 	}
-	return mkerror("user not found")
+	return withoutUser(req), &RoleError{user.Username, user.Role, role}
 }
 
-// CurrentUser returns the currently logged in user and a boolean validating
-// the information.
+// CurrentUser returns the currently logged in user, failing like Authorize.
+// The user stored in the request context by the middleware is reused if
+// available.
 func (a Authorizer) CurrentUser(rw http.ResponseWriter, req *http.Request) (user UserData, e error) {
-	if err := a.Authorize(rw, req, false); err != nil {
-		return user, mkerror(err.Error())
-	}
-	authSession, _ := a.cookiejar.Get(req, "auth")
+	_, user, err := a.authorize(rw, req, false)
+	return user, err
+}
 
-	username, ok := authSession.Values["username"].(string)
-	if !ok {
-		return user, mkerror("User not found in authsession")
+// currentUserForUpdate is like CurrentUser, but always loads the user from
+// the backend, so that changes made earlier in the request aren't lost when
+// the user is saved.
+func (a Authorizer) currentUserForUpdate(rw http.ResponseWriter, req *http.Request) (UserData, error) {
+	user, err := a.CurrentUser(rw, req)
+	if err != nil {
+		return user, err
 	}
-	return a.backend.User(username)
+	user, err = a.backend.User(user.Username)
+	if err == ErrMissingUser {
+		return user, ErrUserNotFound
+	}
+	return user, backendError(err)
 }
 
 // Logout clears an authentication session and add a logged out message.
 func (a Authorizer) Logout(rw http.ResponseWriter, req *http.Request) error {
-	session, _ := a.cookiejar.Get(req, "auth")
+	session, _ := a.authSession(req)
 	defer session.Save(req, rw)
 
+	if username, ok := session.Values["username"].(string); ok {
+		a.emit(req, Event{Type: EventLogout, Username: username})
+	}
 	session.Options.MaxAge = -1 // kill the cookie
-	a.addMessage(rw, req, "Logged out.")
+	a.addMessage(rw, req, a.text(MessageLoggedOut, "Logged out."))
 	return nil
 }
 
-// DeleteUser removes a user from the Authorize. ErrMissingUser is returned if
+// DeleteUser removes a user from the Authorize. ErrDeleteNull is returned if
 // the user to be deleted isn't found.
 func (a Authorizer) DeleteUser(username string) error {
 	err := a.backend.DeleteUser(username)
 	if err != nil && err != ErrDeleteNull {
-		return mkerror(err.Error())
+		return backendError(err)
 	}
 	return err
 }
@@ -347,7 +614,7 @@ func (a Authorizer) DeleteUser(username string) error {
 // the user on a login page or registration page in case something happened
 // (username taken, invalid credentials, successful logout, etc).
 func (a Authorizer) Messages(rw http.ResponseWriter, req *http.Request) []string {
-	session, _ := a.cookiejar.Get(req, "messages")
+	session, _ := a.messageSession(req)
 	flashes := session.Flashes()
 	session.Save(req, rw)
 	var messages []string
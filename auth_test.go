@@ -154,7 +154,7 @@ func TestAuthorizeRole(t *testing.T) {
 		t.Fatalf("AuthorizeRole error: %v", err) // Should work
 	}
 	if err := a.AuthorizeRole(rw, req, "admin", true); err == nil {
-		t.Fatalf("AuthorizeRole error: didn't restrict lower role user", err) // Should work
+		t.Fatal("AuthorizeRole error: didn't restrict lower role user")
 	}
 }
 
@@ -178,3 +178,42 @@ func TestDeleteUser(t *testing.T) {
 
 	os.Remove(file)
 }
+
+func TestKeyRotation(t *testing.T) {
+	old := newTestAuthorizer(t)
+	oldCookies := loginCookies(t, old, "user")
+	mailer := &MemoryMailer{}
+	old.SetEmailConfig(EmailConfig{Mailer: mailer, VerifyURL: "/verify"})
+	old.SendVerificationEmail("user")
+
+	newKey := KeyPair{Hash: []byte("0123456789abcdef0123456789abcdef"), Block: []byte("0123456789abcdef")}
+	rotated, err := NewAuthorizerWithKeys(old.backend, []KeyPair{newKey, {Hash: []byte("testkey")}}, "user", old.Roles())
+	if err != nil {
+		t.Fatalf("NewAuthorizerWithKeys: %v", err)
+	}
+	if err := rotated.Authorize(httptest.NewRecorder(), newTestRequest("GET", oldCookies), false); err != nil {
+		t.Fatalf("Authorize: cookie from old key rejected: %v", err)
+	}
+	if err := rotated.VerifyEmail(mailToken(t, mailer, "user@example.com")); err != nil {
+		t.Fatalf("VerifyEmail: token from old key rejected: %v", err)
+	}
+	newCookies := loginCookies(t, rotated, "admin")
+	if err := old.Authorize(httptest.NewRecorder(), newTestRequest("GET", newCookies), false); err == nil {
+		t.Fatal("Authorize: cookie not written with new key")
+	}
+
+	dropped, _ := NewAuthorizerWithKeys(old.backend, []KeyPair{newKey}, "user", old.Roles())
+	if err := dropped.Authorize(httptest.NewRecorder(), newTestRequest("GET", oldCookies), false); err == nil {
+		t.Fatal("Authorize: cookie from dropped key accepted")
+	}
+	if err := dropped.Authorize(httptest.NewRecorder(), newTestRequest("GET", newCookies), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	if _, err := NewAuthorizerWithKeys(old.backend, []KeyPair{{Hash: []byte("key"), Block: []byte("short")}}, "user", old.Roles()); err == nil {
+		t.Fatal("NewAuthorizerWithKeys: invalid block key accepted")
+	}
+	if _, err := NewAuthorizerWithKeys(old.backend, nil, "user", old.Roles()); err == nil {
+		t.Fatal("NewAuthorizerWithKeys: no keys accepted")
+	}
+}
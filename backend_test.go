@@ -3,6 +3,7 @@ package httpauth
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 func testBackendAuthorizer(t *testing.T, backend AuthBackend) {
@@ -16,12 +17,12 @@ func testBackendAuthorizer(t *testing.T, backend AuthBackend) {
 }
 
 func testBackendSaveUser(t *testing.T, backend AuthBackend) {
-	user2 := UserData{"username2", "email2", []byte("passwordhash2"), "role2"}
+	user2 := UserData{Username: "username2", Email: "email2", Hash: []byte("passwordhash2"), Role: "role2"}
 	if err := backend.SaveUser(user2); err != nil {
 		t.Fatalf("SaveUser sql error: %v", err)
 	}
 
-	user := UserData{"username", "email", []byte("passwordhash"), "role"}
+	user := UserData{Username: "username", Email: "email", Hash: []byte("passwordhash"), Role: "role"}
 	if err := backend.SaveUser(user); err != nil {
 		t.Fatalf("SaveUser sql error: %v", err)
 	}
@@ -54,6 +55,9 @@ func testBackendUser_existing(t *testing.T, backend AuthBackend) {
 		if !bytes.Equal(user.Hash, []byte("passwordhash")) {
 			t.Error("User password not correct.")
 		}
+		if len(user.Roles) != 1 || user.Roles[0] != "role" {
+			t.Errorf("User roles not migrated from role: %v", user.Roles)
+		}
 	} else {
 		t.Errorf("User not found: %v", err)
 	}
@@ -118,10 +122,26 @@ func testBackendUsers(t *testing.T, backend AuthBackend) {
 	if !bytes.Equal(u2.Hash, []byte("passwordhash2")) {
 		t.Error("User password not correct.")
 	}
+
+	if eb, ok := backend.(EmailBackend); ok {
+		users, err := eb.UsersByEmail("email2")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(users) != 1 || users[0].Username != "username2" {
+			t.Errorf("UsersByEmail: wrong users %v", users)
+		}
+		if users, _ := eb.UsersByEmail("nobody"); len(users) != 0 {
+			t.Errorf("UsersByEmail: unexpected users %v", users)
+		}
+	}
 }
 
 func testBackendUpdateUser(t *testing.T, backend AuthBackend) {
-	user2 := UserData{"username", "newemail", []byte("newpassword"), "newrole"}
+	user2 := UserData{Username: "username", Email: "newemail", Hash: []byte("newpassword"), Role: "newrole",
+		EmailVerified: true, TOTPSecret: "totpsecret", TOTPEnabled: true, TOTPLastStep: 55555, RecoveryCodes: []string{"code1", "code2"},
+		LoginNonce: "nonce", SessionGeneration: 3, Roles: []string{"newrole", "support"}, Groups: []string{"staff"},
+		Attributes: map[string]string{"department": "sales", "office": "berlin"}}
 	if err := backend.SaveUser(user2); err != nil {
 		t.Fatalf("SaveUser sql error: %v", err)
 	}
@@ -141,6 +161,27 @@ func testBackendUpdateUser(t *testing.T, backend AuthBackend) {
 	if !bytes.Equal(u2.Hash, []byte("newpassword")) {
 		t.Fatal("User password not correct.")
 	}
+	if !u2.EmailVerified {
+		t.Fatal("User email verification not correct.")
+	}
+	if u2.LoginNonce != "nonce" {
+		t.Fatal("User login nonce not correct.")
+	}
+	if u2.SessionGeneration != 3 {
+		t.Fatal("User session generation not correct.")
+	}
+	if u2.TOTPSecret != "totpsecret" || !u2.TOTPEnabled || u2.TOTPLastStep != 55555 {
+		t.Fatal("User TOTP settings not correct.")
+	}
+	if len(u2.RecoveryCodes) != 2 || u2.RecoveryCodes[0] != "code1" || u2.RecoveryCodes[1] != "code2" {
+		t.Fatalf("User recovery codes not correct: %v", u2.RecoveryCodes)
+	}
+	if len(u2.Roles) != 2 || u2.Roles[1] != "support" || len(u2.Groups) != 1 || u2.Groups[0] != "staff" {
+		t.Fatalf("User roles or groups not correct: %v, %v", u2.Roles, u2.Groups)
+	}
+	if len(u2.Attributes) != 2 || u2.Attributes["office"] != "berlin" {
+		t.Fatalf("User attributes not correct: %v", u2.Attributes)
+	}
 }
 
 func testBackendDeleteUser(t *testing.T, backend AuthBackend) {
@@ -155,6 +196,116 @@ func testBackendDeleteUser(t *testing.T, backend AuthBackend) {
 	}
 }
 
+func testBackendFailures(t *testing.T, backend AuthBackend) {
+	store, ok := backend.(FailureStore)
+	if !ok {
+		t.Fatal("Backend doesn't implement FailureStore")
+	}
+	if r, err := store.Failures("user:nobody"); err != nil || r.Count != 0 {
+		t.Fatalf("Failures: expected empty record, got %+v, %v", r, err)
+	}
+	now := time.Now()
+	for i := 1; i <= 2; i++ {
+		r := FailureRecord{Count: i, First: now, Last: now, LockedUntil: now.Add(time.Hour)}
+		if err := store.SaveFailures("user:username2", r); err != nil {
+			t.Fatalf("SaveFailures error: %v", err)
+		}
+	}
+	r, err := store.Failures("user:username2")
+	if err != nil {
+		t.Fatalf("Failures error: %v", err)
+	}
+	if r.Count != 2 || !r.First.Equal(now) || !r.LockedUntil.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Failures: wrong record %+v", r)
+	}
+}
+
+func testBackendSessions(t *testing.T, store SessionStore) {
+	if _, err := store.Session("nosession"); err != ErrSessionNotFound {
+		t.Fatalf("Session: expected ErrSessionNotFound, got %v", err)
+	}
+	now := time.Now()
+	for _, r := range []SessionRecord{
+		{ID: "session1", Username: "username2", Created: now, LastSeen: now, Expires: now.Add(time.Hour), IP: "10.0.0.1", UserAgent: "agent", Data: "data1"},
+		{ID: "session2", Username: "username2", Created: now, LastSeen: now, Expires: now.Add(time.Hour), Data: "data2"},
+		{ID: "session3", Username: "other", Created: now, LastSeen: now, Expires: now.Add(time.Hour), Data: "data3"},
+	} {
+		if err := store.SaveSession(r); err != nil {
+			t.Fatalf("SaveSession error: %v", err)
+		}
+	}
+	r, err := store.Session("session1")
+	if err != nil {
+		t.Fatalf("Session error: %v", err)
+	}
+	r.LastSeen = now.Add(time.Minute)
+	if err := store.SaveSession(r); err != nil {
+		t.Fatalf("SaveSession error: %v", err)
+	}
+	r, _ = store.Session("session1")
+	if r.Username != "username2" || !r.Created.Equal(now) || !r.LastSeen.Equal(now.Add(time.Minute)) ||
+		r.IP != "10.0.0.1" || r.UserAgent != "agent" || r.Data != "data1" {
+		t.Fatalf("Session: wrong record %+v", r)
+	}
+	if rs, err := store.UserSessions("username2"); err != nil || len(rs) != 2 {
+		t.Fatalf("UserSessions: expected 2 records, got %v, %v", len(rs), err)
+	}
+	if err := store.DeleteUserSessions("other"); err != nil {
+		t.Fatalf("DeleteUserSessions error: %v", err)
+	}
+	if _, err := store.Session("session3"); err != ErrSessionNotFound {
+		t.Fatal("DeleteUserSessions didn't remove record")
+	}
+
+	expired := SessionRecord{ID: "session4", Username: "username2", Created: now, LastSeen: now, Expires: now.Add(-time.Minute)}
+	if err := store.SaveSession(expired); err != nil {
+		t.Fatalf("SaveSession error: %v", err)
+	}
+	if err := store.DeleteExpiredSessions(now); err != nil {
+		t.Fatalf("DeleteExpiredSessions error: %v", err)
+	}
+	if _, err := store.Session("session4"); err != ErrSessionNotFound {
+		t.Fatal("DeleteExpiredSessions didn't remove expired record")
+	}
+	if _, err := store.Session("session1"); err != nil {
+		t.Fatalf("DeleteExpiredSessions removed active record: %v", err)
+	}
+}
+
+func testBackendRoles(t *testing.T, store RoleBackend) {
+	// testBackendAuthorizer stored the roles it was given.
+	if rs, err := store.Roles(); err != nil || len(rs) != 2 {
+		t.Fatalf("Roles: expected 2 roles, got %v, %v", rs, err)
+	}
+	for _, r := range []RoleDefinition{
+		{Name: "moderator", Level: 50},
+		{Name: "moderator", Level: 60, Permissions: []string{"users:ban", "posts:edit"}, Inherits: []string{"user"}},
+		{Name: "guest", Level: 10},
+	} {
+		if err := store.SaveRole(r); err != nil {
+			t.Fatalf("SaveRole error: %v", err)
+		}
+	}
+	if err := store.DeleteRole("guest"); err != nil {
+		t.Fatalf("DeleteRole error: %v", err)
+	}
+}
+
+func testBackendGroups(t *testing.T, store GroupBackend) {
+	for _, g := range []GroupDefinition{
+		{Name: "staff", Roles: []string{"user"}},
+		{Name: "staff", Roles: []string{"user", "moderator"}},
+		{Name: "temp"},
+	} {
+		if err := store.SaveGroup(g); err != nil {
+			t.Fatalf("SaveGroup error: %v", err)
+		}
+	}
+	if err := store.DeleteGroup("temp"); err != nil {
+		t.Fatalf("DeleteGroup error: %v", err)
+	}
+}
+
 func testBackendClose(t *testing.T, backend AuthBackend) {
 	backend.Close()
 }
@@ -168,6 +319,12 @@ func testBackend(t *testing.T, backend AuthBackend) {
 	testBackendUsers(t, backend)
 	testBackendUpdateUser(t, backend)
 	testBackendDeleteUser(t, backend)
+	testBackendFailures(t, backend)
+	if store, ok := backend.(SessionStore); ok {
+		testBackendSessions(t, store)
+	}
+	testBackendRoles(t, backend.(RoleBackend))
+	testBackendGroups(t, backend.(GroupBackend))
 	testBackendClose(t, backend)
 }
 
@@ -190,6 +347,58 @@ func testAfterReopen(t *testing.T, backend AuthBackend) {
 	}
 }
 
+func testFailuresAfterReopen(t *testing.T, backend AuthBackend) {
+	store := backend.(FailureStore)
+	if r, err := store.Failures("user:username2"); err != nil || r.Count != 2 {
+		t.Fatalf("Failures not loaded properly: %+v, %v", r, err)
+	}
+	if err := store.ResetFailures("user:username2"); err != nil {
+		t.Fatalf("ResetFailures error: %v", err)
+	}
+	if r, _ := store.Failures("user:username2"); r.Count != 0 {
+		t.Fatal("ResetFailures didn't remove record")
+	}
+}
+
+func testSessionsAfterReopen(t *testing.T, store SessionStore) {
+	if rs, err := store.UserSessions("username2"); err != nil || len(rs) != 2 {
+		t.Fatalf("Sessions not loaded properly: %v, %v", len(rs), err)
+	}
+	if err := store.DeleteSession("session1"); err != nil {
+		t.Fatalf("DeleteSession error: %v", err)
+	}
+	if _, err := store.Session("session1"); err != ErrSessionNotFound {
+		t.Fatal("DeleteSession didn't remove record")
+	}
+}
+
+func testRolesAfterReopen(t *testing.T, store RoleBackend) {
+	rs, err := store.Roles()
+	if err != nil {
+		t.Fatalf("Roles error: %v", err)
+	}
+	roles := make(map[string]RoleDefinition)
+	for _, r := range rs {
+		roles[r.Name] = r
+	}
+	if len(roles) != 3 || roles["user"].Level != 40 || roles["admin"].Level != 80 || roles["moderator"].Level != 60 {
+		t.Fatalf("Roles not loaded properly: %v", rs)
+	}
+	if m := roles["moderator"]; len(m.Permissions) != 2 || m.Permissions[1] != "posts:edit" || len(m.Inherits) != 1 || m.Inherits[0] != "user" {
+		t.Fatalf("Role permissions not loaded properly: %+v", m)
+	}
+}
+
+func testGroupsAfterReopen(t *testing.T, store GroupBackend) {
+	gs, err := store.Groups()
+	if err != nil {
+		t.Fatalf("Groups error: %v", err)
+	}
+	if len(gs) != 1 || gs[0].Name != "staff" || len(gs[0].Roles) != 2 || gs[0].Roles[1] != "moderator" {
+		t.Fatalf("Groups not loaded properly: %v", gs)
+	}
+}
+
 func testDelete2(t *testing.T, backend AuthBackend) {
 	if err := backend.DeleteUser("username2"); err != nil {
 		t.Fatalf("DeleteUser error: %v", err)
@@ -202,6 +411,12 @@ func testClose2(t *testing.T, backend AuthBackend) {
 
 func testBackend2(t *testing.T, backend AuthBackend) {
 	testAfterReopen(t, backend)
+	testFailuresAfterReopen(t, backend)
+	if store, ok := backend.(SessionStore); ok {
+		testSessionsAfterReopen(t, store)
+	}
+	testRolesAfterReopen(t, backend.(RoleBackend))
+	testGroupsAfterReopen(t, backend.(GroupBackend))
 	testDelete2(t, backend)
 	testClose2(t, backend)
 }
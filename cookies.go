@@ -0,0 +1,162 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Default lifetime of cookies, in seconds.
+const defaultCookieMaxAge = 86400 * 30
+
+// CookieConfig sets the name and attributes of one of the Authorizer's
+// cookies. An empty Name or Path selects the default. MaxAge is in seconds; 0
+// selects the default of 30 days, and a negative value makes a session cookie
+// that browsers drop when they close.
+//
+// Cookies are HttpOnly unless AllowScriptAccess is set. A zero SameSite or
+// http.SameSiteDefaultMode selects http.SameSiteLaxMode.
+//
+// Names starting with "__Host-" require Secure, the Path "/" and no Domain;
+// names starting with "__Secure-" require Secure.
+type CookieConfig struct {
+	Name     string
+	Path     string
+	Domain   string
+	MaxAge   int
+	Secure   bool
+	SameSite http.SameSite
+
+	AllowScriptAccess bool
+}
+
+// CookieOptions configures the three cookies the Authorizer uses: Auth holds
+// the login session, Messages the queue read by Messages, and Redirects the
+// page to return to after logging in. Give each app on a domain its own names
+// so they don't collide.
+type CookieOptions struct {
+	Auth      CookieConfig
+	Messages  CookieConfig
+	Redirects CookieConfig
+}
+
+// DefaultCookieOptions returns the options used unless SetCookieOptions is
+// called: cookies named "auth", "messages" and "redirects" on the path "/",
+// lasting 30 days, HttpOnly and SameSite=Lax.
+func DefaultCookieOptions() CookieOptions {
+	c := CookieConfig{Path: "/", MaxAge: defaultCookieMaxAge, SameSite: http.SameSiteLaxMode}
+	opts := CookieOptions{Auth: c, Messages: c, Redirects: c}
+	opts.Auth.Name = "auth"
+	opts.Messages.Name = "messages"
+	opts.Redirects.Name = "redirects"
+	return opts
+}
+
+// SetCookieOptions changes the names and attributes of the Authorizer's
+// cookies. Renaming a cookie logs out users or drops their messages, since the
+// old cookies are no longer read.
+func (a *Authorizer) SetCookieOptions(opts CookieOptions) error {
+	defaults := DefaultCookieOptions()
+	opts.Auth = opts.Auth.withDefaults(defaults.Auth.Name)
+	opts.Messages = opts.Messages.withDefaults(defaults.Messages.Name)
+	opts.Redirects = opts.Redirects.withDefaults(defaults.Redirects.Name)
+	for _, c := range []CookieConfig{opts.Auth, opts.Messages, opts.Redirects} {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Auth.Name == opts.Messages.Name || opts.Auth.Name == opts.Redirects.Name || opts.Messages.Name == opts.Redirects.Name {
+		return mkerror("cookie names must differ")
+	}
+	a.cookies = opts
+	*a.cookiejar.Options = opts.Auth.options()
+	*a.messageStore.Options = opts.Messages.options()
+	*a.redirectStore.Options = opts.Redirects.options()
+
+	// Cookie values carry a timestamp checked against the longest lifetime.
+	maxAge := defaultCookieMaxAge
+	for _, c := range []CookieConfig{opts.Auth, opts.Messages, opts.Redirects} {
+		if c.MaxAge > maxAge {
+			maxAge = c.MaxAge
+		}
+	}
+	for _, codec := range a.cookiejar.Codecs {
+		if s, ok := codec.(*securecookie.SecureCookie); ok {
+			s.MaxAge(maxAge)
+		}
+	}
+	return nil
+}
+
+// withDefaults fills in the unset fields of c, naming it name if it has no
+// Name.
+func (c CookieConfig) withDefaults(name string) CookieConfig {
+	if c.Name == "" {
+		c.Name = name
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultCookieMaxAge
+	}
+	if c.SameSite == 0 || c.SameSite == http.SameSiteDefaultMode {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
+
+func (c CookieConfig) validate() error {
+	if err := (&http.Cookie{Name: c.Name, Value: "x", Path: c.Path, Domain: c.Domain}).Valid(); err != nil {
+		return fmt.Errorf("httpauth: invalid cookie %q: %w", c.Name, err)
+	}
+	if strings.HasPrefix(c.Name, "__Host-") && (!c.Secure || c.Path != "/" || c.Domain != "") {
+		return fmt.Errorf("httpauth: cookie %q needs Secure, the Path \"/\" and no Domain", c.Name)
+	}
+	if strings.HasPrefix(c.Name, "__Secure-") && !c.Secure {
+		return fmt.Errorf("httpauth: cookie %q needs Secure", c.Name)
+	}
+	return nil
+}
+
+// options converts c to gorilla session options.
+func (c CookieConfig) options() sessions.Options {
+	maxAge := c.MaxAge
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return sessions.Options{
+		Path:     c.Path,
+		Domain:   c.Domain,
+		MaxAge:   maxAge,
+		Secure:   c.Secure,
+		HttpOnly: !c.AllowScriptAccess,
+		SameSite: c.SameSite,
+	}
+}
+
+// newCookieStore returns a cookie store sharing codecs with the Authorizer's
+// other cookies.
+func newCookieStore(codecs []securecookie.Codec, c CookieConfig) *sessions.CookieStore {
+	opts := c.options()
+	return &sessions.CookieStore{Codecs: codecs, Options: &opts}
+}
+
+// authSession returns the login session of req.
+func (a Authorizer) authSession(req *http.Request) (*sessions.Session, error) {
+	return a.authStore.Get(req, a.cookies.Auth.Name)
+}
+
+// messageSession returns the message queue session of req.
+func (a Authorizer) messageSession(req *http.Request) (*sessions.Session, error) {
+	return a.messageStore.Get(req, a.cookies.Messages.Name)
+}
+
+// redirectSession returns the session of req holding the page to return to
+// after logging in.
+func (a Authorizer) redirectSession(req *http.Request) (*sessions.Session, error) {
+	return a.redirectStore.Get(req, a.cookies.Redirects.Name)
+}
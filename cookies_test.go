@@ -0,0 +1,89 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieOptions(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	for _, opts := range []CookieOptions{
+		{Auth: CookieConfig{Name: "__Host-auth"}},
+		{Auth: CookieConfig{Name: "__Host-auth", Secure: true, Domain: "example.com"}},
+		{Auth: CookieConfig{Name: "__Secure-auth"}},
+		{Auth: CookieConfig{Name: "bad name"}},
+		{Messages: CookieConfig{Name: "redirects"}},
+	} {
+		if err := auth.SetCookieOptions(opts); err == nil {
+			t.Errorf("SetCookieOptions: accepted %+v", opts)
+		}
+	}
+
+	err := auth.SetCookieOptions(CookieOptions{
+		Auth:     CookieConfig{Name: "__Host-auth", Secure: true, SameSite: http.SameSiteStrictMode, MaxAge: -1},
+		Messages: CookieConfig{Name: "app-messages", Domain: "example.com", MaxAge: 60},
+	})
+	if err != nil {
+		t.Fatalf("SetCookieOptions: %v", err)
+	}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, "user", "password", ""); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Login: expected one cookie, got %v", cookies)
+	}
+	c := cookies[0]
+	if c.Name != "__Host-auth" || !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Path != "/" || c.MaxAge != 0 {
+		t.Fatalf("Login: wrong cookie %v", c)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	auth.Logout(rw, newTestRequest("GET", cookies))
+	if h := strings.Join(rw.Header()["Set-Cookie"], "\n"); !strings.Contains(h, "app-messages=") || !strings.Contains(h, "Domain=example.com") {
+		t.Fatalf("Logout: message cookie not configured: %v", h)
+	}
+
+	// Another app with its own cookie names doesn't see the session.
+	other := newTestAuthorizer(t)
+	other.backend = auth.backend
+	other.SetCookieOptions(CookieOptions{Auth: CookieConfig{Name: "other-auth"}})
+	if err := other.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); err == nil {
+		t.Fatal("Authorize: session shared between apps")
+	}
+}
+
+func TestCookieDefaults(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	if err := auth.SetCookieOptions(CookieOptions{Auth: CookieConfig{Name: "__Host-auth", Secure: true}}); err != nil {
+		t.Fatalf("SetCookieOptions: %v", err)
+	}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, "user", "password", ""); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Login: partial config lost defaults: %v", cookies)
+	}
+
+	if err := auth.SetCookieOptions(CookieOptions{Auth: CookieConfig{AllowScriptAccess: true, SameSite: http.SameSiteStrictMode}}); err != nil {
+		t.Fatalf("SetCookieOptions: %v", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, req, "user", "password", ""); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	cookies = rw.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Login: attributes not applied: %v", cookies)
+	}
+}
@@ -0,0 +1,232 @@
+package httpauth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ErrInvalidCSRFToken is returned by VerifyCSRFToken for requests without a
+// valid CSRF token.
+var ErrInvalidCSRFToken = mkerror("invalid CSRF token")
+
+// Length of CSRF secrets, in bytes.
+const csrfTokenLength = 32
+
+// CSRFOptions configures CSRF tokens. Requests carry their token in the form
+// field FieldName or the header HeaderName.
+//
+// By default a secret is kept in the "auth" session, logged in or not, and
+// CSRFToken returns it masked differently each time. With DoubleSubmit the
+// token is instead the value of a signed cookie, which scripts of API clients
+// read and send back in the header; Cookie configures it, and is never
+// HttpOnly for that.
+//
+// Logging in starts a new session, and with it a new secret, so forms
+// rendered before need a new token. The "auth" session is also saved for
+// visitors who aren't logged in; with a SessionStore, that makes a record for
+// each of them, so consider DoubleSubmit for public pages with forms.
+type CSRFOptions struct {
+	FieldName    string
+	HeaderName   string
+	DoubleSubmit bool
+	Cookie       CookieConfig
+}
+
+// DefaultCSRFOptions returns the options used unless SetCSRFOptions is
+// called: the field "csrf_token", the header "X-CSRF-Token", and for double
+// submit a cookie named "csrf" on the path "/", lasting 30 days, with
+// SameSite=Lax.
+func DefaultCSRFOptions() CSRFOptions {
+	return CSRFOptions{
+		FieldName:  "csrf_token",
+		HeaderName: "X-CSRF-Token",
+		Cookie:     CookieConfig{Name: "csrf", Path: "/", MaxAge: defaultCookieMaxAge, SameSite: http.SameSiteLaxMode, AllowScriptAccess: true},
+	}
+}
+
+// SetCSRFOptions changes how CSRF tokens are issued and checked. Empty names
+// select the defaults.
+func (a *Authorizer) SetCSRFOptions(opts CSRFOptions) error {
+	defaults := DefaultCSRFOptions()
+	if opts.FieldName == "" {
+		opts.FieldName = defaults.FieldName
+	}
+	if opts.HeaderName == "" {
+		opts.HeaderName = defaults.HeaderName
+	}
+	opts.Cookie = opts.Cookie.withDefaults(defaults.Cookie.Name)
+	opts.Cookie.AllowScriptAccess = true
+	if err := opts.Cookie.validate(); err != nil {
+		return err
+	}
+	a.csrf = opts
+	return nil
+}
+
+// CSRFToken returns a token to include in forms and requests with unsafe
+// methods, creating the secret behind it if needed.
+func (a Authorizer) CSRFToken(rw http.ResponseWriter, req *http.Request) (string, error) {
+	if a.csrf.DoubleSubmit {
+		return a.csrfCookie(rw, req)
+	}
+	session, err := a.authSession(req)
+	if err != nil {
+		// Replace sessions that can't be read, like Login does.
+		session.Values = make(map[interface{}]interface{})
+	}
+	secret, ok := csrfSecret(session.Values["csrf"])
+	if !ok {
+		if secret, err = randomBytes(csrfTokenLength); err != nil {
+			return "", err
+		}
+		session.Values["csrf"] = base64.RawURLEncoding.EncodeToString(secret)
+		if err := session.Save(req, rw); err != nil {
+			return "", err
+		}
+	}
+	return maskCSRFToken(secret)
+}
+
+// CSRFField returns a hidden form input holding a CSRF token, for use in
+// templates. It is empty if no token could be made.
+func (a Authorizer) CSRFField(rw http.ResponseWriter, req *http.Request) template.HTML {
+	token, err := a.CSRFToken(rw, req)
+	if err != nil {
+		a.logf("couldn't make CSRF token: %v", err)
+		return ""
+	}
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(a.csrf.FieldName) +
+		`" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+// VerifyCSRFToken returns ErrInvalidCSRFToken unless req carries a token from
+// CSRFToken in its header or form.
+func (a Authorizer) VerifyCSRFToken(req *http.Request) error {
+	submitted := req.Header.Get(a.csrf.HeaderName)
+	if submitted == "" {
+		submitted = req.PostFormValue(a.csrf.FieldName)
+	}
+	if submitted == "" {
+		return ErrInvalidCSRFToken
+	}
+	if a.csrf.DoubleSubmit {
+		c, err := req.Cookie(a.csrf.Cookie.Name)
+		if err != nil {
+			return ErrInvalidCSRFToken
+		}
+		var secret []byte
+		if securecookie.DecodeMulti(a.csrf.Cookie.Name, c.Value, &secret, a.cookiejar.Codecs...) != nil {
+			return ErrInvalidCSRFToken
+		}
+		if subtle.ConstantTimeCompare([]byte(submitted), []byte(c.Value)) != 1 {
+			return ErrInvalidCSRFToken
+		}
+		return nil
+	}
+	session, err := a.authSession(req)
+	if err != nil {
+		return ErrInvalidCSRFToken
+	}
+	secret, ok := csrfSecret(session.Values["csrf"])
+	if !ok {
+		return ErrInvalidCSRFToken
+	}
+	token, err := base64.RawURLEncoding.DecodeString(submitted)
+	if err != nil || len(token) != 2*csrfTokenLength {
+		return ErrInvalidCSRFToken
+	}
+	if subtle.ConstantTimeCompare(unmaskCSRFToken(token), secret) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+// RequireCSRFToken wraps a handler so that requests with unsafe methods (all
+// but GET, HEAD, OPTIONS and TRACE) are only let through with a valid CSRF
+// token. Others receive a 403 Forbidden, or a JSON error in API mode.
+func (a Authorizer) RequireCSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+		default:
+			if err := a.VerifyCSRFToken(req); err != nil {
+				a.apiError(rw, http.StatusForbidden, CodeInvalidCSRFToken, "Invalid CSRF token.")
+				if !a.apiMode {
+					http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// csrfCookie returns the double submit cookie of req, setting a new one if it
+// is missing or invalid.
+func (a Authorizer) csrfCookie(rw http.ResponseWriter, req *http.Request) (string, error) {
+	name := a.csrf.Cookie.Name
+	// Later calls during the request return the cookie already set.
+	for _, c := range (&http.Response{Header: rw.Header()}).Cookies() {
+		if c.Name == name {
+			return c.Value, nil
+		}
+	}
+	if c, err := req.Cookie(name); err == nil {
+		var secret []byte
+		if securecookie.DecodeMulti(name, c.Value, &secret, a.cookiejar.Codecs...) == nil {
+			return c.Value, nil
+		}
+	}
+	secret, err := randomBytes(csrfTokenLength)
+	if err != nil {
+		return "", err
+	}
+	token, err := securecookie.EncodeMulti(name, secret, a.cookiejar.Codecs...)
+	if err != nil {
+		return "", err
+	}
+	opts := a.csrf.Cookie.options()
+	http.SetCookie(rw, sessions.NewCookie(name, token, &opts))
+	return token, nil
+}
+
+// csrfSecret decodes the secret stored in a session.
+func csrfSecret(v interface{}) ([]byte, bool) {
+	s, _ := v.(string)
+	secret, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(secret) != csrfTokenLength {
+		return nil, false
+	}
+	return secret, true
+}
+
+// maskCSRFToken returns secret XORed with a random pad, prefixed by the pad,
+// so that tokens differ on every page and can't be recovered by compression
+// attacks such as BREACH.
+func maskCSRFToken(secret []byte) (string, error) {
+	pad, err := randomBytes(len(secret))
+	if err != nil {
+		return "", err
+	}
+	token := make([]byte, 2*len(secret))
+	copy(token, pad)
+	for i := range secret {
+		token[len(secret)+i] = pad[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// unmaskCSRFToken reverses maskCSRFToken.
+func unmaskCSRFToken(token []byte) []byte {
+	n := len(token) / 2
+	secret := make([]byte, n)
+	for i := range secret {
+		secret[i] = token[i] ^ token[n+i]
+	}
+	return secret
+}
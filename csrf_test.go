@@ -0,0 +1,123 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// csrfPost sends a POST with the given cookies and form token, and the token
+// header if header is set, through h.
+func csrfPost(h http.Handler, cookies []*http.Cookie, token string, header string) int {
+	req := httptest.NewRequest("POST", "/change", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if header != "" {
+		req.Header.Set("X-CSRF-Token", header)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+func TestCSRFToken(t *testing.T) {
+	sessionStoreModes(t, func(t *testing.T, auth Authorizer) {
+		h := auth.RequireCSRFToken(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+		rw := httptest.NewRecorder()
+		req := newTestRequest("GET", nil)
+		token, err := auth.CSRFToken(rw, req)
+		if err != nil {
+			t.Fatalf("CSRFToken: %v", err)
+		}
+		cookies := rw.Result().Cookies()
+		again, _ := auth.CSRFToken(httptest.NewRecorder(), newTestRequest("GET", cookies))
+		if again == token {
+			t.Fatal("CSRFToken: token not masked")
+		}
+
+		for _, tok := range []string{token, again} {
+			if code := csrfPost(h, cookies, tok, ""); code != http.StatusOK {
+				t.Fatalf("RequireCSRFToken: valid token rejected with %d", code)
+			}
+		}
+		if code := csrfPost(h, cookies, "", token); code != http.StatusOK {
+			t.Fatalf("RequireCSRFToken: token in header rejected with %d", code)
+		}
+		if code := csrfPost(h, cookies, "", ""); code != http.StatusForbidden {
+			t.Fatalf("RequireCSRFToken: expected 403 without token, got %d", code)
+		}
+		if code := csrfPost(h, nil, token, ""); code != http.StatusForbidden {
+			t.Fatalf("RequireCSRFToken: expected 403 without session, got %d", code)
+		}
+		other, _ := auth.CSRFToken(httptest.NewRecorder(), newTestRequest("GET", nil))
+		if code := csrfPost(h, cookies, other, ""); code != http.StatusForbidden {
+			t.Fatalf("RequireCSRFToken: expected 403 for another session's token, got %d", code)
+		}
+
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, newTestRequest("GET", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("RequireCSRFToken: GET rejected with %d", rw.Code)
+		}
+
+		field := string(auth.CSRFField(httptest.NewRecorder(), newTestRequest("GET", cookies)))
+		if !strings.HasPrefix(field, `<input type="hidden" name="csrf_token" value="`) {
+			t.Fatalf("CSRFField: unexpected %q", field)
+		}
+	})
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetAPIMode(true)
+	if err := auth.SetCSRFOptions(CSRFOptions{DoubleSubmit: true, Cookie: CookieConfig{Name: "__Host-csrf"}}); err == nil {
+		t.Fatal("SetCSRFOptions: insecure __Host- cookie accepted")
+	}
+	if err := auth.SetCSRFOptions(CSRFOptions{DoubleSubmit: true, HeaderName: "X-XSRF-Token"}); err != nil {
+		t.Fatalf("SetCSRFOptions: %v", err)
+	}
+	h := auth.RequireCSRFToken(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	req := newTestRequest("GET", nil)
+	token, err := auth.CSRFToken(rw, req)
+	if err != nil {
+		t.Fatalf("CSRFToken: %v", err)
+	}
+	if again, _ := auth.CSRFToken(rw, req); again != token {
+		t.Fatal("CSRFToken: token changed during a request")
+	}
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf" || cookies[0].Value != token || cookies[0].HttpOnly {
+		t.Fatalf("CSRFToken: unexpected cookies %v", cookies)
+	}
+
+	send := func(cookies []*http.Cookie, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/thing", nil)
+		req.Header.Set("X-XSRF-Token", header)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+	if rw := send(cookies, token); rw.Code != http.StatusOK {
+		t.Fatalf("RequireCSRFToken: valid token rejected with %d", rw.Code)
+	}
+	if rw := send(nil, token); rw.Code != http.StatusForbidden || !strings.Contains(rw.Body.String(), CodeInvalidCSRFToken) {
+		t.Fatalf("RequireCSRFToken: expected JSON 403 without cookie, got %d %s", rw.Code, rw.Body)
+	}
+	forged := []*http.Cookie{{Name: "csrf", Value: "forged"}}
+	if rw := send(forged, "forged"); rw.Code != http.StatusForbidden {
+		t.Fatalf("RequireCSRFToken: expected 403 for unsigned cookie, got %d", rw.Code)
+	}
+	if rw := send(cookies, token+"x"); rw.Code != http.StatusForbidden {
+		t.Fatalf("RequireCSRFToken: expected 403 for mismatched token, got %d", rw.Code)
+	}
+}
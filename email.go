@@ -0,0 +1,264 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEmailNotVerified is returned by Login when RequireVerifiedEmail is set and
+// the user hasn't verified their email address yet.
+// ErrNoMailer is returned when sending an email without a Mailer configured.
+var (
+	ErrEmailNotVerified = mkerror("email address not verified")
+	ErrNoMailer         = mkerror("no mailer configured")
+)
+
+// Mail is an email sent by the Authorizer.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users. SMTPMailer sends them through an SMTP server,
+// MemoryMailer keeps them for tests.
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// EmailBackend is implemented by AuthBackends that can look users up by email
+// address without loading all of them. The gob file, SQL and leveldb backends
+// implement it; for other backends, RequestPasswordReset and SendLoginLink go
+// through Users.
+type EmailBackend interface {
+	UsersByEmail(email string) ([]UserData, error)
+}
+
+// SMTPMailer is a Mailer sending plain text emails through the SMTP server at
+// Addr ("host:port"), authenticating with Auth if it isn't nil.
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// Send sends m with smtp.SendMail.
+func (s SMTPMailer) Send(m Mail) error {
+	if strings.ContainsAny(m.To+m.Subject+s.From, "\r\n") {
+		return mkerror("invalid email header")
+	}
+	msg := "From: " + s.From + "\r\n" +
+		"To: " + m.To + "\r\n" +
+		"Subject: " + m.Subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(m.Body, "\n", "\r\n", -1)
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{m.To}, []byte(msg))
+}
+
+// MemoryMailer is a Mailer that keeps sent emails in memory instead of sending
+// them. It is safe for concurrent use.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+// Send records m.
+func (s *MemoryMailer) Send(m Mail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+// Sent returns all emails sent so far, oldest first.
+func (s *MemoryMailer) Sent() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail(nil), s.sent...)
+}
+
+// EmailConfig configures the emails the Authorizer sends.
+//
+// Links in emails are made by adding a "token" query parameter to the
+// corresponding URL, which should lead to a handler passing the token on to
+// the Authorizer: VerifyURL to one calling VerifyEmail, ResetURL to one calling
+// ResetPassword and LoginURL to one calling LoginWithLink.
+type EmailConfig struct {
+	Mailer Mailer
+
+	// VerifyURL is the address of the email verification page. Verification
+	// links expire after VerifyTTL, or 24 hours if zero.
+	VerifyURL string
+	VerifyTTL time.Duration
+
+	// ResetURL is the address of the password reset page. Reset links
+	// expire after ResetTTL, or an hour if zero.
+	ResetURL string
+	ResetTTL time.Duration
+
+	// LoginURL is the address of the page logging users in with links from
+	// SendLoginLink. Login links expire after LoginTTL, or 15 minutes if
+	// zero.
+	LoginURL string
+	LoginTTL time.Duration
+
+	// RequireVerifiedEmail makes Login refuse users who haven't verified
+	// their email address. Users created before verification was enabled
+	// start out unverified too; call MarkEmailsVerified once before turning
+	// it on to keep them from being locked out.
+	RequireVerifiedEmail bool
+}
+
+// SetEmailConfig configures sending emails. If a Mailer is set, Register sends
+// new users a verification link, as does Update when a user changes their
+// email address.
+func (a *Authorizer) SetEmailConfig(config EmailConfig) {
+	if config.VerifyTTL == 0 {
+		config.VerifyTTL = 24 * time.Hour
+	}
+	if config.ResetTTL == 0 {
+		config.ResetTTL = time.Hour
+	}
+	if config.LoginTTL == 0 {
+		config.LoginTTL = 15 * time.Minute
+	}
+	a.email = config
+}
+
+// SendVerificationEmail sends username a new email verification link.
+func (a Authorizer) SendVerificationEmail(username string) error {
+	if a.email.Mailer == nil {
+		return ErrNoMailer
+	}
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
+		return backendError(err)
+	}
+	return a.sendVerificationEmail(user)
+}
+
+func (a Authorizer) sendVerificationEmail(user UserData) error {
+	t, err := a.signToken(tokenVerifyEmail, user.Username, user.Email, a.email.VerifyTTL)
+	if err != nil {
+		return err
+	}
+	link, err := emailLink(a.email.VerifyURL, t)
+	if err != nil {
+		return err
+	}
+	err = a.email.Mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body:    "Confirm your email address for " + user.Username + " by visiting this link:\n\n" + link + "\n",
+	})
+	if err != nil {
+		return fmt.Errorf("httpauth: couldn't send verification email: %w", err)
+	}
+	return nil
+}
+
+// VerifyEmail marks the email address of the user a verification link was
+// sent to as verified. Links stop working when the user changes their email
+// address.
+func (a Authorizer) VerifyEmail(token string) error {
+	t, err := a.parseToken(tokenVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+	user, err := a.backend.User(t.Username)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
+		return backendError(err)
+	}
+	if user.Email != t.Check {
+		return ErrInvalidToken
+	}
+	if user.EmailVerified {
+		return nil
+	}
+	user.EmailVerified = true
+	if err := a.backend.SaveUser(user); err != nil {
+		return backendError(err)
+	}
+	return nil
+}
+
+// MarkEmailsVerified marks the email address of every user in the backend as
+// verified. It is meant to be run once when enabling RequireVerifiedEmail on
+// an existing user base, so that accounts created before verification emails
+// were sent can still log in.
+func (a Authorizer) MarkEmailsVerified() error {
+	users, err := a.backend.Users()
+	if err != nil {
+		return backendError(err)
+	}
+	for _, user := range users {
+		if user.EmailVerified {
+			continue
+		}
+		user.EmailVerified = true
+		if err := a.backend.SaveUser(user); err != nil {
+			return backendError(err)
+		}
+	}
+	return nil
+}
+
+// usersByEmail returns the users with the given email address.
+func (a Authorizer) usersByEmail(email string) ([]UserData, error) {
+	if eb, ok := a.backend.(EmailBackend); ok {
+		return eb.UsersByEmail(email)
+	}
+	all, err := a.backend.Users()
+	if err != nil {
+		return nil, err
+	}
+	var users []UserData
+	for _, user := range all {
+		if user.Email == email {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// mailUsers calls send for every user with the given email address in a new
+// goroutine, logging errors, so that callers take the same time and return
+// the same result whether or not the address belongs to an account.
+func (a Authorizer) mailUsers(email string, what string, send func(user UserData) error) {
+	if email == "" {
+		return
+	}
+	go func() {
+		users, err := a.usersByEmail(email)
+		if err != nil {
+			a.logf("looking up users to send %v: %v", what, err)
+			return
+		}
+		for _, user := range users {
+			if err := send(user); err != nil {
+				a.logf("sending %v to %v: %v", what, user.Username, err)
+			}
+		}
+	}()
+}
+
+// emailLink adds token to base as the "token" query parameter.
+func emailLink(base string, token string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("httpauth: invalid link URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,113 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForMail waits for n emails to have been sent, as some are sent in the
+// background.
+func waitForMail(t *testing.T, mailer *MemoryMailer, n int) []Mail {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mailer.Sent()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d emails, got %d", n, len(mailer.Sent()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return mailer.Sent()
+}
+
+// mailToken returns the token from the link in the last email sent to addr.
+func mailToken(t *testing.T, mailer *MemoryMailer, addr string) string {
+	sent := mailer.Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To != addr {
+			continue
+		}
+		for _, line := range strings.Split(sent[i].Body, "\n") {
+			if u, err := url.Parse(line); err == nil && u.Query().Get("token") != "" {
+				return u.Query().Get("token")
+			}
+		}
+		t.Fatalf("No link in email to %v: %q", addr, sent[i].Body)
+	}
+	t.Fatalf("No email sent to %v", addr)
+	return ""
+}
+
+func TestEmailVerification(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, VerifyURL: "https://example.com/verify?lang=en", RequireVerifiedEmail: true})
+
+	req, _ := http.NewRequest("POST", "/register", nil)
+	newUser := UserData{Username: "new", Email: "new@example.com", EmailVerified: true}
+	if err := auth.Register(httptest.NewRecorder(), req, newUser, "password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if sent := mailer.Sent(); len(sent) != 1 || !strings.Contains(sent[0].Body, "https://example.com/verify?lang=en&token=") {
+		t.Fatalf("Register: expected one verification email, got %+v", sent)
+	}
+	token := mailToken(t, mailer, "new@example.com")
+
+	req, _ = http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(httptest.NewRecorder(), req, "new", "password", ""); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("Login: expected ErrEmailNotVerified, got %v", err)
+	}
+	if err := auth.VerifyEmail(token + "x"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("VerifyEmail: expected ErrInvalidToken for tampered token, got %v", err)
+	}
+	if err := auth.VerifyEmail(token); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	cookies := loginCookies(t, auth, "new")
+
+	// Changing the address requires verifying it again, and old links die.
+	if err := auth.Update(httptest.NewRecorder(), newTestRequest("POST", cookies), "", "other@example.com"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if user, _ := auth.backend.User("new"); user.EmailVerified {
+		t.Fatal("Update: changed email still verified")
+	}
+	if err := auth.VerifyEmail(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("VerifyEmail: expected ErrInvalidToken for old address, got %v", err)
+	}
+	if err := auth.VerifyEmail(mailToken(t, mailer, "other@example.com")); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+}
+
+func TestMarkEmailsVerified(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetEmailConfig(EmailConfig{RequireVerifiedEmail: true})
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(httptest.NewRecorder(), req, "user", "password", ""); !errors.Is(err, ErrEmailNotVerified) {
+		t.Fatalf("Login: expected ErrEmailNotVerified, got %v", err)
+	}
+	if err := auth.MarkEmailsVerified(); err != nil {
+		t.Fatalf("MarkEmailsVerified: %v", err)
+	}
+	loginCookies(t, auth, "user")
+	loginCookies(t, auth, "admin")
+}
+
+func TestVerifyEmailExpired(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, VerifyURL: "/verify", VerifyTTL: -time.Minute})
+	if err := auth.SendVerificationEmail("user"); err != nil {
+		t.Fatalf("SendVerificationEmail: %v", err)
+	}
+	if err := auth.VerifyEmail(mailToken(t, mailer, "user@example.com")); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("VerifyEmail: expected ErrTokenExpired, got %v", err)
+	}
+	if err := auth.SendVerificationEmail("nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("SendVerificationEmail: expected ErrUserNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package httpauth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDeleteNull is returned by DeleteUser when that user didn't exist at the
+// time of call.
+// ErrMissingUser is returned by Users when a user is not found.
+var (
+	ErrDeleteNull  = mkerror("deleting non-existant user")
+	ErrMissingUser = mkerror("can't find user")
+)
+
+// Errors returned by the Authorizer. Use errors.Is to check for them, as they
+// may be wrapped with more detail.
+//
+// ErrAlreadyAuthenticated is returned by Login when the user is already logged
+// in.
+// ErrBadCredentials is returned by Login when the password doesn't match.
+// ErrUserNotFound is returned when a user doesn't exist, including by Login.
+// ErrUserExists is returned by Register when the username is taken.
+// ErrInvalidUser is returned by Register when the user data is incomplete.
+// ErrNotLoggedIn is returned when a request has no logged in user.
+// ErrInsufficientRole is returned by AuthorizeRole when the user's role isn't
+// high enough. The error is a *RoleError.
+// ErrRoleNotFound is returned when a role name is unknown.
+// ErrBackend matches any *BackendError.
+var (
+	ErrAlreadyAuthenticated = mkerror("already authenticated")
+	ErrBadCredentials       = mkerror("password doesn't match")
+	ErrUserNotFound         = mkerror("user not found")
+	ErrUserExists           = mkerror("user already exists")
+	ErrInvalidUser          = mkerror("invalid user")
+	ErrNotLoggedIn          = mkerror("user not logged in")
+	ErrInsufficientRole     = mkerror("user doesn't have high enough role")
+	ErrRoleNotFound         = mkerror("role not found")
+	ErrBackend              = mkerror("backend failure")
+)
+
+func mkerror(msg string) error {
+	return errors.New("httpauth: " + msg)
+}
+
+// BackendError wraps an error returned by an AuthBackend. It matches
+// ErrBackend, and the original error is available through errors.Unwrap.
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return "httpauth: backend: " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the backend.
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrBackend.
+func (e *BackendError) Is(target error) bool {
+	return target == ErrBackend
+}
+
+// backendError wraps err in a *BackendError, unless it already is one or is
+// nil.
+func backendError(err error) error {
+	var be *BackendError
+	if err == nil || errors.As(err, &be) {
+		return err
+	}
+	return &BackendError{err}
+}
+
+// RoleError is returned when a user's role isn't high enough. It matches
+// ErrInsufficientRole.
+type RoleError struct {
+	Username string
+	Role     string // the user's role
+	Required string // the role that was required
+}
+
+func (e *RoleError) Error() string {
+	return fmt.Sprintf("httpauth: user %q has role %q, needs %q", e.Username, e.Role, e.Required)
+}
+
+// Is reports whether target is ErrInsufficientRole.
+func (e *RoleError) Is(target error) bool {
+	return target == ErrInsufficientRole
+}
@@ -0,0 +1,73 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var errTestBackend = errors.New("testbackend: broken")
+
+// brokenBackend fails every lookup.
+type brokenBackend struct {
+	AuthBackend
+}
+
+func (b brokenBackend) User(username string) (UserData, error) {
+	return UserData{}, errTestBackend
+}
+
+func TestAuthorizerErrors(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	req, _ := http.NewRequest("POST", "/", nil)
+
+	err := auth.Login(httptest.NewRecorder(), req, "user", "wrongpassword", "")
+	if !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("Login: expected ErrBadCredentials, got %v", err)
+	}
+	err = auth.Login(httptest.NewRecorder(), req, "nobody", "password", "")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Login: expected ErrUserNotFound, got %v", err)
+	}
+	err = auth.Register(httptest.NewRecorder(), req, UserData{Username: "user", Email: "e"}, "password")
+	if !errors.Is(err, ErrUserExists) {
+		t.Errorf("Register: expected ErrUserExists, got %v", err)
+	}
+	err = auth.Register(httptest.NewRecorder(), req, UserData{Username: "new"}, "password")
+	if !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("Register: expected ErrInvalidUser, got %v", err)
+	}
+	err = auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", nil), false)
+	if !errors.Is(err, ErrNotLoggedIn) {
+		t.Errorf("Authorize: expected ErrNotLoggedIn, got %v", err)
+	}
+
+	cookies := loginCookies(t, auth, "user")
+	err = auth.Login(httptest.NewRecorder(), newTestRequest("POST", cookies), "user", "password", "")
+	if !errors.Is(err, ErrAlreadyAuthenticated) {
+		t.Errorf("Login: expected ErrAlreadyAuthenticated, got %v", err)
+	}
+	err = auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "nope", false)
+	if !errors.Is(err, ErrRoleNotFound) {
+		t.Errorf("AuthorizeRole: expected ErrRoleNotFound, got %v", err)
+	}
+	err = auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "admin", false)
+	var roleErr *RoleError
+	if !errors.Is(err, ErrInsufficientRole) || !errors.As(err, &roleErr) {
+		t.Fatalf("AuthorizeRole: expected a RoleError, got %v", err)
+	}
+	if roleErr.Username != "user" || roleErr.Role != "user" || roleErr.Required != "admin" {
+		t.Errorf("AuthorizeRole: wrong RoleError %+v", roleErr)
+	}
+
+	auth.backend = brokenBackend{auth.backend}
+	err = auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false)
+	if !errors.Is(err, ErrBackend) || !errors.Is(err, errTestBackend) {
+		t.Errorf("Authorize: expected wrapped backend error, got %v", err)
+	}
+	if strings.Count(err.Error(), "httpauth:") != 1 {
+		t.Errorf("Authorize: error prefixed more than once: %v", err)
+	}
+}
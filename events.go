@@ -0,0 +1,94 @@
+package httpauth
+
+import (
+	"net/http"
+	"time"
+)
+
+// EventType identifies what happened in an Event.
+type EventType string
+
+// Events reported to event hooks.
+const (
+	EventLogin         EventType = "login"          // a user logged in
+	EventLoginFailed   EventType = "login_failed"   // wrong password, username or second factor
+	EventLockout       EventType = "lockout"        // a login was refused by the lockout policy
+	EventLogout        EventType = "logout"         // a user logged out
+	EventLogoutAll     EventType = "logout_all"     // all sessions of a user were ended
+	EventRegister      EventType = "register"       // a user registered
+	EventPasswordReset EventType = "password_reset" // a user reset their password by email
+	EventRehash        EventType = "rehash"         // a password hash was upgraded
+)
+
+// Event describes something that happened to a user, for auditing and
+// monitoring.
+type Event struct {
+	Type     EventType
+	Username string
+	IP       string // client IP of the request, if the event happened during one
+	Time     time.Time
+	Err      error        // why a login failed or was refused, or why a rehash failed
+	Rehash   *RehashEvent // set for EventRehash
+}
+
+// Logger receives errors the Authorizer can't return to its caller, such as
+// failures to update lockout counters. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// SetLogger sets the logger. By default nothing is logged.
+func (a *Authorizer) SetLogger(l Logger) {
+	a.logger = l
+}
+
+// AddEventHook adds a function called synchronously for every Event. Hooks
+// should return quickly, since they delay the request that caused the event.
+func (a *Authorizer) AddEventHook(hook func(Event)) {
+	a.hooks = append(a.hooks, hook)
+}
+
+// logf logs a message if a logger is set.
+func (a Authorizer) logf(format string, v ...interface{}) {
+	if a.logger != nil {
+		a.logger.Printf("httpauth: "+format, v...)
+	}
+}
+
+// emit reports an event to the hooks. req may be nil.
+func (a Authorizer) emit(req *http.Request, e Event) {
+	if len(a.hooks) == 0 && (e.Type != EventRehash || a.onRehash == nil) {
+		return
+	}
+	e.Time = time.Now()
+	if req != nil {
+		e.IP = clientIP(req)
+	}
+	for _, hook := range a.hooks {
+		hook(e)
+	}
+	if e.Type == EventRehash && a.onRehash != nil {
+		a.onRehash(*e.Rehash)
+	}
+}
+
+// MessageCatalog replaces the messages shown to users, keyed by the Code
+// constants (and MessageLoggedOut). Messages without an entry keep their
+// English default. In API mode the catalog applies to APIError messages.
+type MessageCatalog map[string]string
+
+// MessageLoggedOut is the MessageCatalog key of the message added by Logout.
+const MessageLoggedOut = "logged_out"
+
+// SetMessageCatalog sets the messages shown to users.
+func (a *Authorizer) SetMessageCatalog(catalog MessageCatalog) {
+	a.catalog = catalog
+}
+
+// text returns the message for key, or fallback if the catalog has none.
+func (a Authorizer) text(key string, fallback string) string {
+	if msg, ok := a.catalog[key]; ok {
+		return msg
+	}
+	return fallback
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -52,13 +53,14 @@ func main() {
 	r.HandleFunc("/login", getLogin).Methods("GET")
 	r.HandleFunc("/register", postRegister).Methods("POST")
 	r.HandleFunc("/login", postLogin).Methods("POST")
-	r.HandleFunc("/admin", handleAdmin).Methods("GET")
+	r.Handle("/admin", aaa.RequireRole("admin", http.HandlerFunc(handleAdmin))).Methods("GET")
 	r.HandleFunc("/add_user", postAddUser).Methods("POST")
 	r.HandleFunc("/change", postChange).Methods("POST")
-	r.HandleFunc("/", handlePage).Methods("GET") // authorized page
-	r.HandleFunc("/logout", handleLogout)
+	r.Handle("/", aaa.RequireLogin(http.HandlerFunc(handlePage))).Methods("GET") // authorized page
+	r.HandleFunc("/logout", handleLogout).Methods("POST")
 
-	http.Handle("/", r)
+	// reject POSTs without a CSRF token
+	http.Handle("/", aaa.RequireCSRFToken(r))
 	fmt.Printf("Server running on port %d\n", port)
 	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 }
@@ -71,15 +73,17 @@ func getLogin(rw http.ResponseWriter, req *http.Request) {
         <body>
         <h1>Httpauth example</h1>
         <h2>Entry Page</h2>
-        <p><b>Messages: %v</b></p>
+        <p><b>Messages: %[1]v</b></p>
         <h3>Login</h3>
         <form action="/login" method="post" id="login">
+            %[2]s
             <input type="text" name="username" placeholder="username"><br>
             <input type="password" name="password" placeholder="password"></br>
             <button type="submit">Login</button>
         </form>
         <h3>Register</h3>
         <form action="/register" method="post" id="register">
+            %[2]s
             <input type="text" name="username" placeholder="username"><br>
             <input type="password" name="password" placeholder="password"></br>
             <input type="email" name="email" placeholder="email@example.com"></br>
@@ -87,13 +91,13 @@ func getLogin(rw http.ResponseWriter, req *http.Request) {
         </form>
         </body>
         </html>
-        `, messages)
+        `, messages, aaa.CSRFField(rw, req))
 }
 
 func postLogin(rw http.ResponseWriter, req *http.Request) {
 	username := req.PostFormValue("username")
 	password := req.PostFormValue("password")
-	if err := aaa.Login(rw, req, username, password, "/"); err != nil && err.Error() == "already authenticated" {
+	if err := aaa.Login(rw, req, username, password, "/"); errors.Is(err, httpauth.ErrAlreadyAuthenticated) {
 		http.Redirect(rw, req, "/", http.StatusSeeOther)
 	} else if err != nil {
 		fmt.Println(err)
@@ -133,16 +137,12 @@ func postChange(rw http.ResponseWriter, req *http.Request) {
 }
 
 func handlePage(rw http.ResponseWriter, req *http.Request) {
-	if err := aaa.Authorize(rw, req, true); err != nil {
-		fmt.Println(err)
-		http.Redirect(rw, req, "/login", http.StatusSeeOther)
-		return
-	}
-	if user, err := aaa.CurrentUser(rw, req); err == nil {
+	if user, ok := httpauth.UserFromContext(req.Context()); ok {
 		type data struct {
 			User httpauth.UserData
+			CSRF template.HTML
 		}
-		d := data{User: user}
+		d := data{User: user, CSRF: aaa.CSRFField(rw, req)}
 		t, err := template.New("page").Parse(`
             <html>
             <head><title>Secret page</title></head>
@@ -151,9 +151,11 @@ func handlePage(rw http.ResponseWriter, req *http.Request) {
                 {{ with .User }}
                     <h2>Hello {{ .Username }}</h2>
                     <p>Your role is '{{ .Role }}'. Your email is {{ .Email }}.</p>
-                    <p>{{ if .Role | eq "admin" }}<a href="/admin">Admin page</a> {{ end }}<a href="/logout">Logout</a></p>
+                    <p>{{ if .Role | eq "admin" }}<a href="/admin">Admin page</a>{{ end }}</p>
+                    <form action="/logout" method="post">{{ $.CSRF }}<button type="submit">Logout</button></form>
                 {{ end }}
                 <form action="/change" method="post" id="change">
+                    {{ .CSRF }}
                     <h3>Change email</h3>
                     <p><input type="email" name="new_email" placeholder="new email"></p>
                     <button type="submit">Submit</button>
@@ -168,24 +170,20 @@ func handlePage(rw http.ResponseWriter, req *http.Request) {
 }
 
 func handleAdmin(rw http.ResponseWriter, req *http.Request) {
-	if err := aaa.AuthorizeRole(rw, req, "admin", true); err != nil {
-		fmt.Println(err)
-		http.Redirect(rw, req, "/login", http.StatusSeeOther)
-		return
-	}
-	if user, err := aaa.CurrentUser(rw, req); err == nil {
+	if user, ok := httpauth.UserFromContext(req.Context()); ok {
 		type data struct {
 			User  httpauth.UserData
 			Roles map[string]httpauth.Role
 			Users []httpauth.UserData
 			Msg   []string
+			CSRF  template.HTML
 		}
 		messages := aaa.Messages(rw, req)
 		users, err := backend.Users()
 		if err != nil {
 			panic(err)
 		}
-		d := data{User: user, Roles: roles, Users: users, Msg: messages}
+		d := data{User: user, Roles: aaa.Roles(), Users: users, Msg: messages, CSRF: aaa.CSRFField(rw, req)}
 		t, err := template.New("admin").Parse(`
             <html>
             <head><title>Admin page</title></head>
@@ -194,10 +192,12 @@ func handleAdmin(rw http.ResponseWriter, req *http.Request) {
                 <h2>Admin Page</h2>
                 <p>{{.Msg}}</p>
                 {{ with .User }}<p>Hello {{ .Username }}, your role is '{{ .Role }}'. Your email is {{ .Email }}.</p>{{ end }}
-                <p><a href="/">Back</a> <a href="/logout">Logout</a></p>
+                <p><a href="/">Back</a></p>
+                <form action="/logout" method="post">{{ .CSRF }}<button type="submit">Logout</button></form>
                 <h3>Users</h3>
                 <ul>{{ range .Users }}<li>{{.Username}}</li>{{ end }}</ul>
                 <form action="/add_user" method="post" id="add_user">
+                    {{ .CSRF }}
                     <h3>Add user</h3>
                     <p><input type="text" name="username" placeholder="username"><br>
                     <input type="password" name="password" placeholder="password"><br>
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 )
 
 // ErrMissingBackend is returned by NewGobFileAuthBackend when the file doesn't
@@ -15,9 +16,16 @@ var (
 )
 
 // GobFileAuthBackend stores user data and the location of the gob file.
+//
+// The file holds the map of users, followed by the maps of login failure
+// records, roles and groups. It is safe for concurrent use.
 type GobFileAuthBackend struct {
 	filepath string
+	mu       *sync.Mutex // guards the maps and the file
 	users    map[string]UserData
+	failures map[string]FailureRecord
+	roles    map[string]RoleDefinition
+	groups   map[string]GroupDefinition
 }
 
 // NewGobFileAuthBackend initializes a new backend by loading a map of users
@@ -25,6 +33,7 @@ type GobFileAuthBackend struct {
 // If the file doesn't exist, returns an error.
 func NewGobFileAuthBackend(filepath string) (b GobFileAuthBackend, e error) {
 	b.filepath = filepath
+	b.mu = new(sync.Mutex)
 	if _, err := os.Stat(b.filepath); err == nil {
 		f, err := os.Open(b.filepath)
 		defer f.Close()
@@ -33,6 +42,9 @@ func NewGobFileAuthBackend(filepath string) (b GobFileAuthBackend, e error) {
 		}
 		dec := gob.NewDecoder(f)
 		dec.Decode(&b.users)
+		dec.Decode(&b.failures)
+		dec.Decode(&b.roles)
+		dec.Decode(&b.groups)
 	} else if !os.IsNotExist(err) {
 		return b, fmt.Errorf("gobfilebackend: %v", err.Error())
 	} else {
@@ -41,13 +53,25 @@ func NewGobFileAuthBackend(filepath string) (b GobFileAuthBackend, e error) {
 	if b.users == nil {
 		b.users = make(map[string]UserData)
 	}
+	if b.failures == nil {
+		b.failures = make(map[string]FailureRecord)
+	}
+	if b.roles == nil {
+		b.roles = make(map[string]RoleDefinition)
+	}
+	if b.groups == nil {
+		b.groups = make(map[string]GroupDefinition)
+	}
 	return b, nil
 }
 
 // User returns the user with the given username. Error is set to
 // ErrMissingUser if user is not found.
 func (b GobFileAuthBackend) User(username string) (user UserData, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if user, ok := b.users[username]; ok {
+		migrateRoles(&user)
 		return user, nil
 	}
 	return user, ErrMissingUser
@@ -55,15 +79,33 @@ func (b GobFileAuthBackend) User(username string) (user UserData, e error) {
 
 // Users returns a slice of all users.
 func (b GobFileAuthBackend) Users() (us []UserData, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	for _, user := range b.users {
+		migrateRoles(&user)
 		us = append(us, user)
 	}
 	return
 }
 
+// UsersByEmail returns the users with the given email address.
+func (b GobFileAuthBackend) UsersByEmail(email string) (us []UserData, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, user := range b.users {
+		if user.Email == email {
+			migrateRoles(&user)
+			us = append(us, user)
+		}
+	}
+	return
+}
+
 // SaveUser adds a new user, replacing one with the same username, and saves a
 // gob file.
 func (b GobFileAuthBackend) SaveUser(user UserData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.users[user.Username] = user
 	err := b.save()
 	return err
@@ -78,23 +120,119 @@ func (b GobFileAuthBackend) save() error {
 	enc := gob.NewEncoder(f)
 	err = enc.Encode(b.users)
 	if err != nil {
-		fmt.Errorf("gobfilebackend: save: %v", err)
+		return fmt.Errorf("gobfilebackend: save: %v", err)
+	}
+	err = enc.Encode(b.failures)
+	if err != nil {
+		return fmt.Errorf("gobfilebackend: save: %v", err)
+	}
+	err = enc.Encode(b.roles)
+	if err != nil {
+		return fmt.Errorf("gobfilebackend: save: %v", err)
+	}
+	err = enc.Encode(b.groups)
+	if err != nil {
+		return fmt.Errorf("gobfilebackend: save: %v", err)
 	}
 	return nil
 }
 
 // DeleteUser removes a user, raising ErrDeleteNull if that user was missing.
 func (b GobFileAuthBackend) DeleteUser(username string) error {
-	_, err := b.User(username)
-	if err == ErrMissingUser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.users[username]; !ok {
 		return ErrDeleteNull
-	} else if err != nil {
-		return fmt.Errorf("gobfilebackend: %v", err)
 	}
 	delete(b.users, username)
 	return b.save()
 }
 
+// Failures returns the login failure record for key.
+func (b GobFileAuthBackend) Failures(key string) (FailureRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures[key], nil
+}
+
+// SaveFailures replaces the login failure record for key and saves a gob
+// file.
+func (b GobFileAuthBackend) SaveFailures(key string, r FailureRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[key] = r
+	return b.save()
+}
+
+// ResetFailures removes the login failure record for key.
+func (b GobFileAuthBackend) ResetFailures(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.failures[key]; !ok {
+		return nil
+	}
+	delete(b.failures, key)
+	return b.save()
+}
+
+// Roles returns all stored role definitions.
+func (b GobFileAuthBackend) Roles() (rs []RoleDefinition, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.roles {
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// SaveRole adds or replaces a role definition and saves a gob file.
+func (b GobFileAuthBackend) SaveRole(r RoleDefinition) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roles[r.Name] = r
+	return b.save()
+}
+
+// DeleteRole removes a role definition.
+func (b GobFileAuthBackend) DeleteRole(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.roles[name]; !ok {
+		return nil
+	}
+	delete(b.roles, name)
+	return b.save()
+}
+
+// Groups returns all stored group definitions.
+func (b GobFileAuthBackend) Groups() (gs []GroupDefinition, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, g := range b.groups {
+		gs = append(gs, g)
+	}
+	return gs, nil
+}
+
+// SaveGroup adds or replaces a group definition and saves a gob file.
+func (b GobFileAuthBackend) SaveGroup(g GroupDefinition) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[g.Name] = g
+	return b.save()
+}
+
+// DeleteGroup removes a group definition.
+func (b GobFileAuthBackend) DeleteGroup(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.groups[name]; !ok {
+		return nil
+	}
+	delete(b.groups, name)
+	return b.save()
+}
+
 // Close cleans up the backend. Currently a no-op for gobfiles.
 func (b GobFileAuthBackend) Close() {
 
@@ -0,0 +1,227 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrGroupExists is returned when adding a group whose name is taken.
+// ErrGroupNotFound is returned when a group name is unknown.
+// ErrInvalidGroup is returned for empty group names and ones with commas.
+// ErrGroupInUse matches the *GroupInUseError returned by DeleteGroup.
+var (
+	ErrGroupExists   = mkerror("group already exists")
+	ErrGroupNotFound = mkerror("group not found")
+	ErrInvalidGroup  = mkerror("invalid group")
+	ErrGroupInUse    = mkerror("group in use")
+)
+
+// GroupInUseError is returned by DeleteGroup for a group that still has
+// members. It matches ErrGroupInUse.
+type GroupInUseError struct {
+	Group string
+	Users []string // usernames of the members, sorted
+}
+
+func (e *GroupInUseError) Error() string {
+	return fmt.Sprintf("httpauth: group %q has %d members", e.Group, len(e.Users))
+}
+
+// Is reports whether target is ErrGroupInUse.
+func (e *GroupInUseError) Is(target error) bool {
+	return target == ErrGroupInUse
+}
+
+// GroupDefinition is a group as stored by a GroupBackend. Users listing the
+// group in UserData.Groups hold all of its Roles.
+type GroupDefinition struct {
+	Name  string
+	Roles []string
+}
+
+// GroupBackend is implemented by AuthBackends that store group definitions,
+// so that groups persist and are shared by every Authorizer using the
+// backend. The gob file, SQL and leveldb backends implement it. Without one,
+// groups only live as long as the Authorizer.
+type GroupBackend interface {
+	Groups() ([]GroupDefinition, error)
+	// SaveGroup adds a group, or replaces the one with the same name.
+	SaveGroup(g GroupDefinition) error
+	DeleteGroup(name string) error
+}
+
+// storedGroups returns the groups stored by the backend, or nil if it isn't a
+// GroupBackend.
+func (a Authorizer) storedGroups() (map[string]GroupDefinition, error) {
+	gb, ok := a.backend.(GroupBackend)
+	if !ok {
+		return nil, nil
+	}
+	stored, err := gb.Groups()
+	if err != nil {
+		return nil, backendError(err)
+	}
+	groups := make(map[string]GroupDefinition, len(stored))
+	for _, g := range stored {
+		groups[g.Name] = g
+	}
+	return groups, nil
+}
+
+// Groups returns the current groups, sorted by name.
+func (a Authorizer) Groups() []GroupDefinition {
+	a.roles.mu.RLock()
+	defer a.roles.mu.RUnlock()
+	groups := make([]GroupDefinition, 0, len(a.roles.groups))
+	for _, g := range a.roles.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// AddGroup adds a group whose members hold the given roles.
+func (a Authorizer) AddGroup(name string, roles ...string) error {
+	if name == "" || strings.Contains(name, ",") {
+		return fmt.Errorf("%w: %q", ErrInvalidGroup, name)
+	}
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	if _, ok := a.roles.groups[name]; ok {
+		return fmt.Errorf("%w: %q", ErrGroupExists, name)
+	}
+	if err := a.roles.checkRoles(roles); err != nil {
+		return err
+	}
+	return a.saveGroup(GroupDefinition{Name: name, Roles: append([]string(nil), roles...)})
+}
+
+// SetGroupRoles replaces the roles a group grants. Members' sessions are
+// kept, and their new roles apply to their next request.
+func (a Authorizer) SetGroupRoles(name string, roles ...string) error {
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	g, ok := a.roles.groups[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrGroupNotFound, name)
+	}
+	if err := a.roles.checkRoles(roles); err != nil {
+		return err
+	}
+	g.Roles = append([]string(nil), roles...)
+	return a.saveGroup(g)
+}
+
+// DeleteGroup removes a group. It returns a *GroupInUseError while users are
+// still members.
+func (a Authorizer) DeleteGroup(name string) error {
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	if _, ok := a.roles.groups[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrGroupNotFound, name)
+	}
+	users, err := a.backend.Users()
+	if err != nil {
+		return backendError(err)
+	}
+	inUse := &GroupInUseError{Group: name}
+	for _, user := range users {
+		if containsString(user.Groups, name) {
+			inUse.Users = append(inUse.Users, user.Username)
+		}
+	}
+	if len(inUse.Users) > 0 {
+		sort.Strings(inUse.Users)
+		return inUse
+	}
+	if gb, ok := a.backend.(GroupBackend); ok {
+		if err := gb.DeleteGroup(name); err != nil {
+			return backendError(err)
+		}
+	}
+	delete(a.roles.groups, name)
+	return nil
+}
+
+// SetUserGroups makes username a member of the given groups, replacing the
+// ones they were in. Their sessions are ended as by ChangeRole. Returns
+// ErrUserNotFound, or ErrGroupNotFound for groups the Authorizer doesn't
+// know.
+func (a Authorizer) SetUserGroups(rw http.ResponseWriter, req *http.Request, username string, groups ...string) error {
+	if err := a.roles.checkGroups(groups); err != nil {
+		return err
+	}
+	return a.changeUser(rw, req, username, func(user *UserData) {
+		user.Groups = append([]string(nil), groups...)
+	})
+}
+
+// saveGroup stores g, in the backend if it is a GroupBackend. The caller holds
+// the lock.
+func (a Authorizer) saveGroup(g GroupDefinition) error {
+	if gb, ok := a.backend.(GroupBackend); ok {
+		if err := gb.SaveGroup(g); err != nil {
+			return backendError(err)
+		}
+	}
+	a.roles.groups[g.Name] = g
+	return nil
+}
+
+// userRoles returns the names of the roles user holds, directly or through
+// their groups. Unknown groups are skipped.
+func (s *roleSet) userRoles(user UserData) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var roles []string
+	add := func(names []string) {
+		for _, name := range names {
+			if name != "" && !containsString(roles, name) {
+				roles = append(roles, name)
+			}
+		}
+	}
+	add([]string{user.Role})
+	add(user.Roles)
+	for _, name := range user.Groups {
+		add(s.groups[name].Roles)
+	}
+	return roles
+}
+
+// checkRoles returns ErrRoleNotFound if any of roles is unknown. The caller
+// holds the lock.
+func (s *roleSet) checkRoles(roles []string) error {
+	for _, name := range roles {
+		if _, ok := s.defs[name]; !ok {
+			return fmt.Errorf("%w: %q", ErrRoleNotFound, name)
+		}
+	}
+	return nil
+}
+
+// checkGroups returns ErrGroupNotFound if any of groups is unknown.
+func (s *roleSet) checkGroups(groups []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, name := range groups {
+		if _, ok := s.groups[name]; !ok {
+			return fmt.Errorf("%w: %q", ErrGroupNotFound, name)
+		}
+	}
+	return nil
+}
+
+// migrateRoles fills in Roles for users stored before it existed, when Role
+// was their only role, and makes sure Role is among Roles. Backends call it on
+// the users they load.
+func migrateRoles(user *UserData) {
+	if user.Role == "" && len(user.Roles) > 0 {
+		user.Role = user.Roles[0]
+	}
+	if user.Role != "" && !containsString(user.Roles, user.Role) {
+		user.Roles = append([]string{user.Role}, user.Roles...)
+	}
+}
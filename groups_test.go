@@ -0,0 +1,131 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMultipleRoles(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	for name, level := range map[string]Role{"support": 30, "billing": 50} {
+		if err := auth.AddRole(name, level); err != nil {
+			t.Fatalf("AddRole: %v", err)
+		}
+	}
+	auth.GrantPermission("support", "tickets:reply")
+	auth.GrantPermission("billing", "invoices:refund")
+
+	if err := auth.SetUserRoles(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "support", "nobody"); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("SetUserRoles: expected ErrRoleNotFound, got %v", err)
+	}
+	if err := auth.SetUserRoles(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "support", "billing"); err != nil {
+		t.Fatalf("SetUserRoles: %v", err)
+	}
+	if user, _ := auth.backend.User("user"); user.Role != "support" || !reflect.DeepEqual(user.Roles, []string{"support", "billing"}) {
+		t.Fatalf("SetUserRoles: wrong roles %q, %v", user.Role, user.Roles)
+	}
+	cookies := loginCookies(t, auth, "user")
+	for _, permission := range []string{"tickets:reply", "invoices:refund"} {
+		if err := auth.AuthorizePermission(httptest.NewRecorder(), newTestRequest("GET", cookies), permission); err != nil {
+			t.Errorf("AuthorizePermission(%q): %v", permission, err)
+		}
+	}
+	// The highest level counts.
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "user", false); err != nil {
+		t.Fatalf("AuthorizeRole: %v", err)
+	}
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "admin", false); !errors.Is(err, ErrInsufficientRole) {
+		t.Fatalf("AuthorizeRole: expected ErrInsufficientRole, got %v", err)
+	}
+
+	var inUse *RoleInUseError
+	if err := auth.DeleteRole("billing"); !errors.As(err, &inUse) || !reflect.DeepEqual(inUse.Users, []string{"user"}) {
+		t.Fatalf("DeleteRole: expected *RoleInUseError, got %v", err)
+	}
+	if err := auth.RenameRole("billing", "finance"); err != nil {
+		t.Fatalf("RenameRole: %v", err)
+	}
+	if user, _ := auth.backend.User("user"); !reflect.DeepEqual(user.Roles, []string{"support", "finance"}) {
+		t.Fatalf("RenameRole: roles not moved: %v", user.Roles)
+	}
+
+	if err := auth.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "admin"); err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	if user, _ := auth.backend.User("user"); user.Role != "admin" || !reflect.DeepEqual(user.Roles, []string{"admin"}) {
+		t.Fatalf("ChangeRole: wrong roles %q, %v", user.Role, user.Roles)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.AddRole("support", 30)
+	auth.GrantPermission("support", "tickets:reply")
+
+	if err := auth.AddGroup("staff", "support", "nobody"); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("AddGroup: expected ErrRoleNotFound, got %v", err)
+	}
+	if err := auth.AddGroup("a,b"); !errors.Is(err, ErrInvalidGroup) {
+		t.Fatalf("AddGroup: expected ErrInvalidGroup, got %v", err)
+	}
+	if err := auth.AddGroup("staff", "support"); err != nil {
+		t.Fatalf("AddGroup: %v", err)
+	}
+	if err := auth.AddGroup("staff"); !errors.Is(err, ErrGroupExists) {
+		t.Fatalf("AddGroup: expected ErrGroupExists, got %v", err)
+	}
+	if err := auth.SetUserGroups(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "nobody"); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("SetUserGroups: expected ErrGroupNotFound, got %v", err)
+	}
+	if err := auth.SetUserGroups(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "staff"); err != nil {
+		t.Fatalf("SetUserGroups: %v", err)
+	}
+	cookies := loginCookies(t, auth, "user")
+	if err := auth.AuthorizePermission(httptest.NewRecorder(), newTestRequest("GET", cookies), "tickets:reply"); err != nil {
+		t.Fatalf("AuthorizePermission: group role not applied: %v", err)
+	}
+
+	// Changing the group applies to its members without logging them out.
+	if err := auth.SetGroupRoles("staff", "admin"); err != nil {
+		t.Fatalf("SetGroupRoles: %v", err)
+	}
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "admin", false); err != nil {
+		t.Fatalf("AuthorizeRole: group role not applied: %v", err)
+	}
+	var roleInUse *RoleInUseError
+	if err := auth.DeleteRole("admin"); !errors.As(err, &roleInUse) || !reflect.DeepEqual(roleInUse.Groups, []string{"staff"}) {
+		t.Fatalf("DeleteRole: expected *RoleInUseError for group, got %v", err)
+	}
+	if err := auth.RenameRole("admin", "root"); err != nil {
+		t.Fatalf("RenameRole: %v", err)
+	}
+	if groups := auth.Groups(); len(groups) != 1 || !reflect.DeepEqual(groups[0].Roles, []string{"root"}) {
+		t.Fatalf("RenameRole: group not moved: %v", groups)
+	}
+
+	// Groups are stored by the backend.
+	other, err := NewAuthorizer(auth.backend, []byte("testkey"), "user", auth.Roles())
+	if err != nil {
+		t.Fatalf("NewAuthorizer: %v", err)
+	}
+	if !reflect.DeepEqual(other.Groups(), auth.Groups()) {
+		t.Fatalf("Groups: expected %v, got %v", auth.Groups(), other.Groups())
+	}
+
+	var inUse *GroupInUseError
+	if err := auth.DeleteGroup("staff"); !errors.As(err, &inUse) || !reflect.DeepEqual(inUse.Users, []string{"user"}) {
+		t.Fatalf("DeleteGroup: expected *GroupInUseError, got %v", err)
+	}
+	auth.SetUserGroups(httptest.NewRecorder(), newTestRequest("POST", nil), "user")
+	if err := auth.DeleteGroup("staff"); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if err := other.ReloadRoles(); err != nil {
+		t.Fatalf("ReloadRoles: %v", err)
+	}
+	if groups := other.Groups(); len(groups) != 0 {
+		t.Fatalf("ReloadRoles: deleted group still listed: %v", groups)
+	}
+}
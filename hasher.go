@@ -0,0 +1,332 @@
+package httpauth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrUnknownHash is returned when verifying a password against a hash that
+// wasn't produced by one of the package's PasswordHashers.
+var ErrUnknownHash = mkerror("unknown password hash format")
+
+// PasswordHasher hashes and verifies passwords. Hashes must be self
+// describing, so that a hash can be verified no matter which PasswordHasher
+// the Authorizer is currently configured with. BcryptHasher produces the
+// standard "$2a$" format, Argon2idHasher and ScryptHasher produce PHC strings
+// (https://github.com/P-H-C/phc-string-format).
+type PasswordHasher interface {
+	// Hash returns a hash of password, including its salt and parameters.
+	Hash(password string) ([]byte, error)
+	// Verify reports whether password matches hash.
+	Verify(hash []byte, password string) (bool, error)
+	// NeedsRehash reports whether hash was produced by a different algorithm
+	// or with different parameters than the PasswordHasher would use now.
+	NeedsRehash(hash []byte) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt. It's the Authorizer's default.
+type BcryptHasher struct {
+	Cost int // defaults to bcrypt.DefaultCost
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+// Hash returns a bcrypt hash of password.
+func (h BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.cost())
+}
+
+// Verify reports whether password matches a bcrypt hash.
+func (h BcryptHasher) Verify(hash []byte, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash reports whether hash isn't a bcrypt hash with h's cost.
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.cost()
+}
+
+// Argon2idHasher hashes passwords with argon2id. Zero fields use the defaults
+// recommended by RFC 9106 for memory constrained environments.
+type Argon2idHasher struct {
+	Time    uint32 // number of passes, defaults to 3
+	Memory  uint32 // in KiB, defaults to 64 MiB
+	Threads uint8  // defaults to 4
+	KeyLen  uint32 // defaults to 32
+	SaltLen uint32 // defaults to 16
+}
+
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	if h.Time == 0 {
+		h.Time = 3
+	}
+	if h.Memory == 0 {
+		h.Memory = 64 * 1024
+	}
+	if h.Threads == 0 {
+		h.Threads = 4
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+	return h
+}
+
+// Hash returns an argon2id hash of password in PHC string format.
+func (h Argon2idHasher) Hash(password string) ([]byte, error) {
+	h = h.withDefaults()
+	salt, err := randomBytes(int(h.SaltLen))
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key))), nil
+}
+
+// Verify reports whether password matches an argon2id hash. The parameters
+// stored in the hash are used, not the ones set on h.
+func (h Argon2idHasher) Verify(hash []byte, password string) (bool, error) {
+	p, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether hash isn't an argon2id hash with h's parameters.
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	p, _, _, err := parseArgon2id(hash)
+	return err != nil || p != h.withDefaults()
+}
+
+func parseArgon2id(hash []byte) (p Argon2idHasher, salt, key []byte, err error) {
+	fields := strings.Split(string(hash), "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("httpauth: unsupported argon2id version %q", fields[2])
+	}
+	if _, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("httpauth: invalid argon2id parameters: %w", err)
+	}
+	if salt, err = b64.DecodeString(fields[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("httpauth: invalid argon2id salt: %w", err)
+	}
+	if key, err = b64.DecodeString(fields[5]); err != nil {
+		return p, nil, nil, fmt.Errorf("httpauth: invalid argon2id hash: %w", err)
+	}
+	p.KeyLen = uint32(len(key))
+	p.SaltLen = uint32(len(salt))
+	return p, salt, key, nil
+}
+
+// ScryptHasher hashes passwords with scrypt. Zero fields use the defaults
+// recommended by the scrypt package for interactive logins.
+type ScryptHasher struct {
+	LogN    uint8 // log2 of the CPU/memory cost N, defaults to 15
+	R       int   // block size, defaults to 8
+	P       int   // parallelism, defaults to 1
+	KeyLen  int   // defaults to 32
+	SaltLen int   // defaults to 16
+}
+
+func (h ScryptHasher) withDefaults() ScryptHasher {
+	if h.LogN == 0 {
+		h.LogN = 15
+	}
+	if h.R == 0 {
+		h.R = 8
+	}
+	if h.P == 0 {
+		h.P = 1
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+	return h
+}
+
+// Hash returns a scrypt hash of password in PHC string format.
+func (h ScryptHasher) Hash(password string) ([]byte, error) {
+	h = h.withDefaults()
+	salt, err := randomBytes(h.SaltLen)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P,
+		b64.EncodeToString(salt), b64.EncodeToString(key))), nil
+}
+
+// Verify reports whether password matches a scrypt hash. The parameters
+// stored in the hash are used, not the ones set on h.
+func (h ScryptHasher) Verify(hash []byte, password string) (bool, error) {
+	p, salt, key, err := parseScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether hash isn't a scrypt hash with h's parameters.
+func (h ScryptHasher) NeedsRehash(hash []byte) bool {
+	p, _, _, err := parseScrypt(hash)
+	return err != nil || p != h.withDefaults()
+}
+
+func parseScrypt(hash []byte) (p ScryptHasher, salt, key []byte, err error) {
+	fields := strings.Split(string(hash), "$")
+	if len(fields) != 5 || fields[1] != "scrypt" {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err = fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return p, nil, nil, fmt.Errorf("httpauth: invalid scrypt parameters: %w", err)
+	}
+	if salt, err = b64.DecodeString(fields[3]); err != nil {
+		return p, nil, nil, fmt.Errorf("httpauth: invalid scrypt salt: %w", err)
+	}
+	if key, err = b64.DecodeString(fields[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("httpauth: invalid scrypt hash: %w", err)
+	}
+	p.KeyLen = len(key)
+	p.SaltLen = len(salt)
+	return p, salt, key, nil
+}
+
+// b64 is the base64 variant used by PHC strings.
+var b64 = base64.RawStdEncoding
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("httpauth: reading random bytes: %w", err)
+	}
+	return b, nil
+}
+
+// hasherFor returns a PasswordHasher able to verify hash, based on its
+// identifier.
+func hasherFor(hash []byte) (PasswordHasher, error) {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$2a$")), bytes.HasPrefix(hash, []byte("$2b$")),
+		bytes.HasPrefix(hash, []byte("$2y$")):
+		return BcryptHasher{}, nil
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		return Argon2idHasher{}, nil
+	case bytes.HasPrefix(hash, []byte("$scrypt$")):
+		return ScryptHasher{}, nil
+	}
+	return nil, ErrUnknownHash
+}
+
+// hashAlgorithm returns the name of the algorithm that produced hash.
+func hashAlgorithm(hash []byte) string {
+	switch h, _ := hasherFor(hash); h.(type) {
+	case BcryptHasher:
+		return "bcrypt"
+	case Argon2idHasher:
+		return "argon2id"
+	case ScryptHasher:
+		return "scrypt"
+	}
+	return "unknown"
+}
+
+// VerifyPassword reports whether password matches hash, which may have been
+// produced by any of the package's PasswordHashers.
+func VerifyPassword(hash []byte, password string) (bool, error) {
+	h, err := hasherFor(hash)
+	if err != nil {
+		return false, err
+	}
+	return h.Verify(hash, password)
+}
+
+// verifyPassword is like VerifyPassword, but falls back to the Authorizer's
+// PasswordHasher for hashes the package doesn't recognise.
+func (a Authorizer) verifyPassword(hash []byte, password string) (bool, error) {
+	if _, err := hasherFor(hash); err != nil {
+		return a.hasher.Verify(hash, password)
+	}
+	return VerifyPassword(hash, password)
+}
+
+// SetPasswordHasher sets the PasswordHasher used to hash new passwords in
+// Register and Update. Existing hashes can still be verified by Login
+// regardless of which of the package's algorithms produced them; other
+// hashes are verified by h. Defaults to a BcryptHasher
+// with the default cost.
+func (a *Authorizer) SetPasswordHasher(h PasswordHasher) {
+	a.hasher = h
+}
+
+// RehashEvent describes a password hash that Login upgraded to the current
+// PasswordHasher's algorithm and parameters.
+type RehashEvent struct {
+	Username     string
+	OldAlgorithm string
+	NewAlgorithm string
+	Err          error // set if the new hash couldn't be generated or saved
+}
+
+// SetRehashHook sets a function called every time Login tries to upgrade an
+// outdated password hash. Event hooks receive the same information as
+// EventRehash events.
+func (a *Authorizer) SetRehashHook(hook func(RehashEvent)) {
+	a.onRehash = hook
+}
+
+// rehash replaces user's password hash with one produced by the current
+// PasswordHasher, returning the updated user. Failures are reported to the
+// hooks but otherwise ignored, leaving the old hash in place.
+func (a Authorizer) rehash(user UserData, password string) UserData {
+	event := RehashEvent{Username: user.Username, OldAlgorithm: hashAlgorithm(user.Hash)}
+	hash, err := a.hasher.Hash(password)
+	if err == nil {
+		event.NewAlgorithm = hashAlgorithm(hash)
+		updated := user
+		updated.Hash = hash
+		if err = a.backend.SaveUser(updated); err == nil {
+			user = updated
+		}
+		err = backendError(err)
+	}
+	event.Err = err
+	a.emit(nil, Event{Type: EventRehash, Username: user.Username, Err: event.Err, Rehash: &event})
+	return user
+}
@@ -0,0 +1,167 @@
+package httpauth
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testHashers = map[string]PasswordHasher{
+	"bcrypt":   BcryptHasher{Cost: 4},
+	"argon2id": Argon2idHasher{Time: 1, Memory: 1024, Threads: 1},
+	"scrypt":   ScryptHasher{LogN: 10},
+}
+
+func TestPasswordHashers(t *testing.T) {
+	prefixes := map[string]string{
+		"bcrypt":   "$2a$04$",
+		"argon2id": "$argon2id$v=19$m=1024,t=1,p=1$",
+		"scrypt":   "$scrypt$ln=10,r=8,p=1$",
+	}
+	for name, h := range testHashers {
+		hash, err := h.Hash("password")
+		if err != nil {
+			t.Fatalf("%v: Hash: %v", name, err)
+		}
+		if !bytes.HasPrefix(hash, []byte(prefixes[name])) {
+			t.Errorf("%v: unexpected hash format %s", name, hash)
+		}
+		if ok, err := h.Verify(hash, "password"); !ok || err != nil {
+			t.Errorf("%v: Verify failed on correct password: %v", name, err)
+		}
+		if ok, err := VerifyPassword(hash, "password"); !ok || err != nil {
+			t.Errorf("%v: VerifyPassword failed on correct password: %v", name, err)
+		}
+		if ok, _ := VerifyPassword(hash, "wrongpassword"); ok {
+			t.Errorf("%v: VerifyPassword accepted wrong password", name)
+		}
+	}
+	if _, err := VerifyPassword([]byte("plaintext"), "plaintext"); err != ErrUnknownHash {
+		t.Errorf("VerifyPassword: expected ErrUnknownHash, got %v", err)
+	}
+}
+
+func TestMixedHashLogin(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	req, _ := http.NewRequest("POST", "/", nil)
+	for name, h := range testHashers {
+		auth.SetPasswordHasher(h)
+		if err := auth.Register(httptest.NewRecorder(), req, UserData{Username: name, Email: name}, "password"); err != nil {
+			t.Fatalf("%v: Register: %v", name, err)
+		}
+	}
+	auth.SetPasswordHasher(BcryptHasher{})
+	for name := range testHashers {
+		loginCookies(t, auth, name)
+	}
+}
+
+// reverseHasher is a PasswordHasher the package doesn't know about.
+type reverseHasher struct{}
+
+func (reverseHasher) Hash(password string) ([]byte, error) {
+	b := []byte("rev:" + password)
+	for i, j := 4, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b, nil
+}
+
+func (h reverseHasher) Verify(hash []byte, password string) (bool, error) {
+	want, _ := h.Hash(password)
+	return bytes.Equal(hash, want), nil
+}
+
+func (reverseHasher) NeedsRehash(hash []byte) bool {
+	return !bytes.HasPrefix(hash, []byte("rev:"))
+}
+
+func TestCustomHasherLogin(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetPasswordHasher(reverseHasher{})
+	req, _ := http.NewRequest("POST", "/", nil)
+	if err := auth.Register(httptest.NewRecorder(), req, UserData{Username: "custom", Email: "custom"}, "password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	loginCookies(t, auth, "custom")
+	// Hashes the package knows are still verified.
+	loginCookies(t, auth, "user")
+
+	rw := httptest.NewRecorder()
+	if err := auth.Login(rw, newTestRequest("POST", nil), "custom", "wrongpassword", "/"); err != ErrBadCredentials {
+		t.Fatalf("Login: expected ErrBadCredentials, got %v", err)
+	}
+}
+
+func TestLoginRehash(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetPasswordHasher(testHashers["argon2id"])
+	var events []RehashEvent
+	auth.SetRehashHook(func(e RehashEvent) {
+		events = append(events, e)
+	})
+
+	loginCookies(t, auth, "user")
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 rehash event, got %d", len(events))
+	}
+	if e := events[0]; e.Username != "user" || e.OldAlgorithm != "bcrypt" || e.NewAlgorithm != "argon2id" || e.Err != nil {
+		t.Fatalf("Wrong rehash event: %+v", e)
+	}
+	user, err := auth.backend.User("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.hasher.NeedsRehash(user.Hash) {
+		t.Fatalf("Hash not upgraded: %s", user.Hash)
+	}
+
+	loginCookies(t, auth, "user")
+	if len(events) != 1 {
+		t.Fatal("Up to date hash was rehashed")
+	}
+
+	auth.SetPasswordHasher(BcryptHasher{Cost: 5})
+	loginCookies(t, auth, "user")
+	if len(events) != 2 || events[1].NewAlgorithm != "bcrypt" {
+		t.Fatal("Hash not rehashed after changing algorithm")
+	}
+	user, _ = auth.backend.User("user")
+	if !bytes.HasPrefix(user.Hash, []byte("$2a$05$")) {
+		t.Fatalf("Hash not upgraded: %s", user.Hash)
+	}
+}
+
+// failingHasher is a PasswordHasher that can't make new hashes.
+type failingHasher struct {
+	BcryptHasher
+}
+
+var errTestHasher = errors.New("testhasher: broken")
+
+func (failingHasher) Hash(password string) ([]byte, error) {
+	return nil, errTestHasher
+}
+
+func (failingHasher) NeedsRehash(hash []byte) bool {
+	return true
+}
+
+func TestLoginRehashFailure(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetPasswordHasher(failingHasher{})
+	var events []RehashEvent
+	auth.SetRehashHook(func(e RehashEvent) {
+		events = append(events, e)
+	})
+
+	loginCookies(t, auth, "user")
+	if len(events) != 1 || !errors.Is(events[0].Err, errTestHasher) {
+		t.Fatalf("Expected a rehash event with the hasher error, got %+v", events)
+	}
+	if errors.Is(events[0].Err, ErrBackend) {
+		t.Fatalf("Hasher error reported as a backend error: %v", events[0].Err)
+	}
+}
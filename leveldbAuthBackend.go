@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
 	"os"
+	"sync"
+	"time"
 )
 
 // ErrMissingLeveldbBackend is returned by NewLeveldbAuthBackend when the file
@@ -18,10 +20,18 @@ var (
 // LeveldbAuthBackend stores user data and the location of a leveldb file.
 //
 // Current implementation holds all user data in memory, flushing to leveldb
-// as a single value to the key "httpauth::userdata" on saves.
+// as a single value to the key "httpauth::userdata" on saves. Login failure
+// records, sessions, roles and groups are kept the same way under
+// "httpauth::failures", "httpauth::sessions", "httpauth::roles" and
+// "httpauth::groups". It is safe for concurrent use.
 type LeveldbAuthBackend struct {
 	filepath string
+	mu       *sync.Mutex // guards the maps and the file
 	users    map[string]UserData
+	failures map[string]FailureRecord
+	sessions map[string]SessionRecord
+	roles    map[string]RoleDefinition
+	groups   map[string]GroupDefinition
 }
 
 // NewLeveldbAuthBackend initializes a new backend by loading a map of users
@@ -29,6 +39,7 @@ type LeveldbAuthBackend struct {
 // If the file doesn't exist, returns an error.
 func NewLeveldbAuthBackend(filepath string) (b LeveldbAuthBackend, e error) {
 	b.filepath = filepath
+	b.mu = new(sync.Mutex)
 	if _, err := os.Stat(b.filepath); err == nil {
 		db, err := leveldb.OpenFile(b.filepath, nil)
 		defer db.Close()
@@ -40,19 +51,50 @@ func NewLeveldbAuthBackend(filepath string) (b LeveldbAuthBackend, e error) {
 		if err != nil {
 			b.users = make(map[string]UserData)
 		}
+		data, err = db.Get([]byte("httpauth::failures"), nil)
+		if err == nil {
+			json.Unmarshal(data, &b.failures)
+		}
+		data, err = db.Get([]byte("httpauth::sessions"), nil)
+		if err == nil {
+			json.Unmarshal(data, &b.sessions)
+		}
+		data, err = db.Get([]byte("httpauth::roles"), nil)
+		if err == nil {
+			json.Unmarshal(data, &b.roles)
+		}
+		data, err = db.Get([]byte("httpauth::groups"), nil)
+		if err == nil {
+			json.Unmarshal(data, &b.groups)
+		}
 	} else {
 		return b, ErrMissingLeveldbBackend
 	}
 	if b.users == nil {
 		b.users = make(map[string]UserData)
 	}
+	if b.failures == nil {
+		b.failures = make(map[string]FailureRecord)
+	}
+	if b.sessions == nil {
+		b.sessions = make(map[string]SessionRecord)
+	}
+	if b.roles == nil {
+		b.roles = make(map[string]RoleDefinition)
+	}
+	if b.groups == nil {
+		b.groups = make(map[string]GroupDefinition)
+	}
 	return b, nil
 }
 
 // User returns the user with the given username. Error is set to
 // ErrMissingUser if user is not found.
 func (b LeveldbAuthBackend) User(username string) (user UserData, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if user, ok := b.users[username]; ok {
+		migrateRoles(&user)
 		return user, nil
 	}
 	return user, ErrMissingUser
@@ -60,15 +102,33 @@ func (b LeveldbAuthBackend) User(username string) (user UserData, e error) {
 
 // Users returns a slice of all users.
 func (b LeveldbAuthBackend) Users() (us []UserData, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	for _, user := range b.users {
+		migrateRoles(&user)
 		us = append(us, user)
 	}
 	return
 }
 
+// UsersByEmail returns the users with the given email address.
+func (b LeveldbAuthBackend) UsersByEmail(email string) (us []UserData, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, user := range b.users {
+		if user.Email == email {
+			migrateRoles(&user)
+			us = append(us, user)
+		}
+	}
+	return
+}
+
 // SaveUser adds a new user, replacing one with the same username, and flushes
 // to the db.
 func (b LeveldbAuthBackend) SaveUser(user UserData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.users[user.Username] = user
 	err := b.save()
 	return err
@@ -88,21 +148,204 @@ func (b LeveldbAuthBackend) save() error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("leveldbauthbackend: save: %v", err))
 	}
+	data, err = json.Marshal(b.failures)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	err = db.Put([]byte("httpauth::failures"), data, nil)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	data, err = json.Marshal(b.sessions)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	err = db.Put([]byte("httpauth::sessions"), data, nil)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	data, err = json.Marshal(b.roles)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	err = db.Put([]byte("httpauth::roles"), data, nil)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	data, err = json.Marshal(b.groups)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
+	err = db.Put([]byte("httpauth::groups"), data, nil)
+	if err != nil {
+		return fmt.Errorf("leveldbauthbackend: save: %v", err)
+	}
 	return nil
 }
 
 // DeleteUser removes a user, raising ErrDeleteNull if that user was missing.
 func (b LeveldbAuthBackend) DeleteUser(username string) error {
-	_, err := b.User(username)
-	if err == ErrMissingUser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.users[username]; !ok {
 		return ErrDeleteNull
-	} else if err != nil {
-		return fmt.Errorf("leveldbauthbackend: %v", err)
 	}
 	delete(b.users, username)
 	return b.save()
 }
 
+// Failures returns the login failure record for key.
+func (b LeveldbAuthBackend) Failures(key string) (FailureRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures[key], nil
+}
+
+// SaveFailures replaces the login failure record for key and flushes to the
+// db.
+func (b LeveldbAuthBackend) SaveFailures(key string, r FailureRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[key] = r
+	return b.save()
+}
+
+// ResetFailures removes the login failure record for key.
+func (b LeveldbAuthBackend) ResetFailures(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.failures[key]; !ok {
+		return nil
+	}
+	delete(b.failures, key)
+	return b.save()
+}
+
+// Session returns the session record with the given ID.
+func (b LeveldbAuthBackend) Session(id string) (SessionRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.sessions[id]
+	if !ok {
+		return r, ErrSessionNotFound
+	}
+	return r, nil
+}
+
+// SaveSession adds or replaces a session record and flushes to the db.
+func (b LeveldbAuthBackend) SaveSession(r SessionRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[r.ID] = r
+	return b.save()
+}
+
+// DeleteSession removes the session record with the given ID.
+func (b LeveldbAuthBackend) DeleteSession(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.sessions[id]; !ok {
+		return nil
+	}
+	delete(b.sessions, id)
+	return b.save()
+}
+
+// UserSessions returns all session records of username.
+func (b LeveldbAuthBackend) UserSessions(username string) (rs []SessionRecord, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.sessions {
+		if r.Username == username {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+// DeleteUserSessions removes all session records of username.
+func (b LeveldbAuthBackend) DeleteUserSessions(username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, r := range b.sessions {
+		if r.Username == username {
+			delete(b.sessions, id)
+		}
+	}
+	return b.save()
+}
+
+// DeleteExpiredSessions removes all session records that expired before the
+// given time.
+func (b LeveldbAuthBackend) DeleteExpiredSessions(before time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, r := range b.sessions {
+		if r.Expires.Before(before) {
+			delete(b.sessions, id)
+		}
+	}
+	return b.save()
+}
+
+// Roles returns all stored role definitions.
+func (b LeveldbAuthBackend) Roles() (rs []RoleDefinition, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.roles {
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// SaveRole adds or replaces a role definition and flushes to the db.
+func (b LeveldbAuthBackend) SaveRole(r RoleDefinition) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roles[r.Name] = r
+	return b.save()
+}
+
+// DeleteRole removes a role definition.
+func (b LeveldbAuthBackend) DeleteRole(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.roles[name]; !ok {
+		return nil
+	}
+	delete(b.roles, name)
+	return b.save()
+}
+
+// Groups returns all stored group definitions.
+func (b LeveldbAuthBackend) Groups() (gs []GroupDefinition, e error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, g := range b.groups {
+		gs = append(gs, g)
+	}
+	return gs, nil
+}
+
+// SaveGroup adds or replaces a group definition and flushes to the db.
+func (b LeveldbAuthBackend) SaveGroup(g GroupDefinition) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[g.Name] = g
+	return b.save()
+}
+
+// DeleteGroup removes a group definition.
+func (b LeveldbAuthBackend) DeleteGroup(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.groups[name]; !ok {
+		return nil
+	}
+	delete(b.groups, name)
+	return b.save()
+}
+
 // Close cleans up the backend. Currently a no-op for gobfiles.
 func (b LeveldbAuthBackend) Close() {
 
@@ -0,0 +1,285 @@
+package httpauth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrAccountLocked matches the *LockoutError returned by Login when an account
+// has been locked after too many failed logins.
+// ErrThrottled matches the *LockoutError returned by Login when a client IP has
+// to wait before trying again.
+var (
+	ErrAccountLocked = mkerror("account locked")
+	ErrThrottled     = mkerror("too many failed logins")
+)
+
+// LockoutError is returned by Login when it refuses to check credentials
+// because of earlier failures. It matches ErrAccountLocked if Username is set
+// and ErrThrottled otherwise.
+type LockoutError struct {
+	Username string // set if the account is locked
+	IP       string // set if the client IP is throttled
+	Until    time.Time
+}
+
+func (e *LockoutError) Error() string {
+	if e.Username != "" {
+		return "httpauth: account " + e.Username + " locked until " + e.Until.Format(time.RFC3339)
+	}
+	return "httpauth: too many failed logins from " + e.IP + ", retry after " + e.Until.Format(time.RFC3339)
+}
+
+// Is reports whether target is ErrAccountLocked or ErrThrottled, depending on
+// what was locked.
+func (e *LockoutError) Is(target error) bool {
+	if e.Username != "" {
+		return target == ErrAccountLocked
+	}
+	return target == ErrThrottled
+}
+
+// LockoutPolicy configures how Login reacts to failed attempts.
+//
+// An account is locked for Duration once MaxFailures failures happened within
+// Window of the first one. Independently, every failure from a client IP
+// makes that IP wait before its next attempt, starting at IPBaseDelay and
+// doubling up to IPMaxDelay (an hour if zero). Counters start over once Window
+// has passed since their first failure; account counters are also cleared by
+// a successful login. Failures for usernames that don't exist only count
+// against the client IP.
+//
+// Setting MaxFailures or IPBaseDelay to zero disables that part of the policy.
+type LockoutPolicy struct {
+	MaxFailures int
+	Window      time.Duration
+	Duration    time.Duration
+	IPBaseDelay time.Duration
+	IPMaxDelay  time.Duration
+}
+
+// FailureRecord counts failed logins for an account or client IP.
+type FailureRecord struct {
+	Count       int
+	First       time.Time // first failure in the current window
+	Last        time.Time // most recent failure
+	LockedUntil time.Time // no attempts are allowed before this time
+}
+
+// FailureStore stores FailureRecords by key. Keys are "user:" followed by a
+// username or "ip:" followed by an IP address.
+//
+// MemoryFailureStore keeps records in memory. The package's AuthBackends also
+// implement FailureStore, persisting records next to the users.
+type FailureStore interface {
+	// Failures returns the record for key, or a zero record if there is
+	// none.
+	Failures(key string) (FailureRecord, error)
+	SaveFailures(key string, r FailureRecord) error
+	ResetFailures(key string) error
+}
+
+// MemoryFailureStore is a FailureStore keeping records in memory. It is safe
+// for concurrent use.
+type MemoryFailureStore struct {
+	mu      sync.Mutex
+	records map[string]FailureRecord
+}
+
+// NewMemoryFailureStore returns an empty MemoryFailureStore.
+func NewMemoryFailureStore() *MemoryFailureStore {
+	return &MemoryFailureStore{records: make(map[string]FailureRecord)}
+}
+
+// Failures returns the record for key.
+func (s *MemoryFailureStore) Failures(key string) (FailureRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+// SaveFailures replaces the record for key.
+func (s *MemoryFailureStore) SaveFailures(key string, r FailureRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = r
+	return nil
+}
+
+// ResetFailures removes the record for key.
+func (s *MemoryFailureStore) ResetFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// SetLockout enables locking accounts and throttling client IPs after failed
+// logins, with failures counted in store. Pass a nil store to disable it.
+func (a *Authorizer) SetLockout(policy LockoutPolicy, store FailureStore) {
+	a.lockout = policy
+	a.failures = store
+}
+
+// checkLockout returns a *LockoutError if a login for username from req isn't
+// allowed yet.
+func (a Authorizer) checkLockout(req *http.Request, username string) error {
+	if a.failures == nil {
+		return nil
+	}
+	now := time.Now()
+	if ip := clientIP(req); ip != "" && a.lockout.IPBaseDelay > 0 {
+		r, err := a.failures.Failures("ip:" + ip)
+		if err != nil {
+			return backendError(err)
+		}
+		if now.Before(r.LockedUntil) {
+			return &LockoutError{IP: ip, Until: r.LockedUntil}
+		}
+	}
+	if a.lockout.MaxFailures > 0 {
+		r, err := a.failures.Failures("user:" + username)
+		if err != nil {
+			return backendError(err)
+		}
+		if now.Before(r.LockedUntil) {
+			return &LockoutError{Username: username, Until: r.LockedUntil}
+		}
+	}
+	return nil
+}
+
+// reportLockout tells the client why checkLockout refused a login.
+func (a Authorizer) reportLockout(rw http.ResponseWriter, req *http.Request, err error) {
+	var lockErr *LockoutError
+	if errors.As(err, &lockErr) {
+		a.emit(req, Event{Type: EventLockout, Username: lockErr.Username, Err: err})
+	}
+	if errors.Is(err, ErrAccountLocked) {
+		a.fail(rw, req, http.StatusLocked, CodeAccountLocked, "This account is locked. Try again later.")
+	} else if errors.Is(err, ErrThrottled) {
+		a.fail(rw, req, http.StatusTooManyRequests, CodeThrottled, "Too many failed logins. Try again later.")
+	} else {
+		a.backendFailure(rw, err)
+	}
+}
+
+// keyedMutex serializes work on the same key, like updating the failure
+// record of one account, while work on other keys goes on in parallel.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyLock)}
+}
+
+// lock locks key, returning a function that unlocks it.
+func (m *keyedMutex) lock(key string) (unlock func()) {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{}
+		m.locks[key] = l
+	}
+	l.waiters++
+	m.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// recordFailure reports a failed login for username from req, and counts it,
+// locking the account or throttling the IP as the policy requires. Nothing is
+// stored for usernames that don't exist, so guessing them can't fill the
+// store. Records are updated one failure at a time, so that parallel attempts
+// can't get past the limits; this holds within one process. Store errors are
+// only logged; the login has failed either way.
+func (a Authorizer) recordFailure(req *http.Request, username string, reason error) {
+	a.emit(req, Event{Type: EventLoginFailed, Username: username, Err: reason})
+	if a.failures == nil {
+		return
+	}
+	now := time.Now()
+	if ip := clientIP(req); ip != "" && a.lockout.IPBaseDelay > 0 {
+		unlock := a.locks.lock("ip:" + ip)
+		r := a.nextFailure("ip:"+ip, now)
+		maxDelay := a.lockout.IPMaxDelay
+		if maxDelay == 0 {
+			maxDelay = time.Hour
+		}
+		delay := a.lockout.IPBaseDelay
+		for i := 1; i < r.Count && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		r.LockedUntil = now.Add(delay)
+		if err := a.failures.SaveFailures("ip:"+ip, r); err != nil {
+			a.logf("saving login failures of %v: %v", ip, err)
+		}
+		unlock()
+	}
+	if a.lockout.MaxFailures > 0 && reason != ErrUserNotFound {
+		unlock := a.locks.lock("user:" + username)
+		r := a.nextFailure("user:"+username, now)
+		if r.Count >= a.lockout.MaxFailures {
+			r.LockedUntil = now.Add(a.lockout.Duration)
+		}
+		if err := a.failures.SaveFailures("user:"+username, r); err != nil {
+			a.logf("saving login failures of %v: %v", username, err)
+		}
+		unlock()
+	}
+}
+
+// nextFailure returns the record for key with a failure at now added,
+// starting a new window if the first failure is too old.
+func (a Authorizer) nextFailure(key string, now time.Time) FailureRecord {
+	r, _ := a.failures.Failures(key)
+	if r.Count == 0 || (a.lockout.Window > 0 && now.Sub(r.First) > a.lockout.Window) {
+		r = FailureRecord{First: now}
+	}
+	r.Count++
+	r.Last = now
+	return r
+}
+
+// resetFailures clears the counter for username after a successful login.
+// Client IP counters are left to expire, so an attacker can't clear them by
+// logging in to their own account.
+func (a Authorizer) resetFailures(username string) {
+	if a.failures == nil || a.lockout.MaxFailures == 0 {
+		return
+	}
+	if err := a.failures.ResetFailures("user:" + username); err != nil {
+		a.logf("resetting login failures of %v: %v", username, err)
+	}
+}
+
+// clientIP returns the IP address a request came from. Proxy headers aren't
+// trusted; put a middleware that rewrites RemoteAddr in front of the
+// Authorizer if needed.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,121 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func lockoutLogin(auth Authorizer, ip string, username string, password string) error {
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.RemoteAddr = ip + ":1234"
+	return auth.Login(httptest.NewRecorder(), req, username, password, "")
+}
+
+func TestAccountLockout(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetLockout(LockoutPolicy{MaxFailures: 3, Window: time.Minute, Duration: time.Hour}, NewMemoryFailureStore())
+
+	for i := 0; i < 3; i++ {
+		if err := lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword"); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("Login: expected ErrBadCredentials, got %v", err)
+		}
+	}
+	err := lockoutLogin(auth, "10.0.0.2", "user", "password")
+	var lockErr *LockoutError
+	if !errors.Is(err, ErrAccountLocked) || !errors.As(err, &lockErr) {
+		t.Fatalf("Login: expected ErrAccountLocked, got %v", err)
+	}
+	if lockErr.Username != "user" || lockErr.Until.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("Login: wrong LockoutError %+v", lockErr)
+	}
+	if err := lockoutLogin(auth, "10.0.0.2", "admin", "password"); err != nil {
+		t.Fatalf("Login: other account locked too: %v", err)
+	}
+}
+
+func TestLockoutResetOnSuccess(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetLockout(LockoutPolicy{MaxFailures: 2, Window: time.Minute, Duration: time.Hour}, auth.backend.(FailureStore))
+
+	lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+	if err := lockoutLogin(auth, "10.0.0.1", "user", "password"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+	if err := lockoutLogin(auth, "10.0.0.1", "user", "password"); err != nil {
+		t.Fatalf("Login: failures not reset by successful login: %v", err)
+	}
+}
+
+func TestIPThrottling(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	store := NewMemoryFailureStore()
+	auth.SetLockout(LockoutPolicy{IPBaseDelay: time.Minute, IPMaxDelay: 3 * time.Minute}, store)
+
+	lockoutLogin(auth, "10.0.0.1", "nobody", "password")
+	err := lockoutLogin(auth, "10.0.0.1", "user", "password")
+	if !errors.Is(err, ErrThrottled) || errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("Login: expected ErrThrottled, got %v", err)
+	}
+	if err := lockoutLogin(auth, "10.0.0.2", "user", "password"); err != nil {
+		t.Fatalf("Login: other IP throttled too: %v", err)
+	}
+
+	// Let the delay run out and fail again; each failure doubles the delay.
+	for i, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+		r, _ := store.Failures("ip:10.0.0.1")
+		r.LockedUntil = time.Now()
+		store.SaveFailures("ip:10.0.0.1", r)
+		lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+		r, _ = store.Failures("ip:10.0.0.1")
+		if delay := r.LockedUntil.Sub(r.Last); delay != expected {
+			t.Fatalf("Failure %d: expected delay %v, got %v", i+2, expected, delay)
+		}
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	store := NewMemoryFailureStore()
+	auth.SetLockout(LockoutPolicy{MaxFailures: 3, Window: time.Minute, Duration: time.Hour}, store)
+
+	// Unknown usernames aren't stored.
+	lockoutLogin(auth, "10.0.0.1", "nobody", "password")
+	if r, _ := store.Failures("user:nobody"); r.Count != 0 {
+		t.Fatalf("Login: failure stored for unknown user: %+v", r)
+	}
+
+	// The window counts from the first failure, not the last.
+	lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+	lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+	r, _ := store.Failures("user:user")
+	r.First = time.Now().Add(-2 * time.Minute)
+	store.SaveFailures("user:user", r)
+	lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+	if r, _ := store.Failures("user:user"); r.Count != 1 {
+		t.Fatalf("Login: window not restarted, count %d", r.Count)
+	}
+}
+
+func TestConcurrentFailures(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	store := auth.backend.(FailureStore)
+	auth.SetLockout(LockoutPolicy{MaxFailures: 100, Window: time.Minute, Duration: time.Hour}, store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lockoutLogin(auth, "10.0.0.1", "user", "wrongpassword")
+		}()
+	}
+	wg.Wait()
+	if r, _ := store.Failures("user:user"); r.Count != 20 {
+		t.Fatalf("Expected 20 failures, got %d", r.Count)
+	}
+}
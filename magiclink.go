@@ -0,0 +1,102 @@
+package httpauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// SendLoginLink emails a one time login link to every user with the given
+// email address, for logging in without a password. Each user has at most one
+// working link; sending a new one invalidates the last, as does changing the
+// user's email address. To avoid revealing which addresses have accounts, the
+// new links are stored and emailed in the background, and errors doing so are
+// only logged.
+func (a Authorizer) SendLoginLink(email string) error {
+	if a.email.Mailer == nil {
+		return ErrNoMailer
+	}
+	a.mailUsers(email, "login link", func(user UserData) error {
+		b, err := randomBytes(16)
+		if err != nil {
+			return err
+		}
+		nonce := hex.EncodeToString(b)
+		user.LoginNonce = hashNonce(nonce)
+		if err := a.backend.SaveUser(user); err != nil {
+			return backendError(err)
+		}
+		// The nonce is hex, so the first colon separates it from the address.
+		t, err := a.signToken(tokenLogin, user.Username, nonce+":"+user.Email, a.email.LoginTTL)
+		if err != nil {
+			return err
+		}
+		link, err := emailLink(a.email.LoginURL, t)
+		if err != nil {
+			return err
+		}
+		return a.email.Mailer.Send(Mail{
+			To:      user.Email,
+			Subject: "Your login link",
+			Body: "Visit this link to log in as " + user.Username + ":\n\n" + link +
+				"\n\nIf you didn't ask for it, you can ignore this email.\n",
+		})
+	})
+	return nil
+}
+
+// LoginWithLink logs a user in with the token from a link sent by
+// SendLoginLink. It behaves like Login, including redirects to dest and the
+// second factor for users who have it enabled. Since the link proves the user
+// reads mail sent to their address, it is marked as verified.
+//
+// Returns ErrInvalidToken or ErrTokenExpired for bad, used or expired links.
+func (a Authorizer) LoginWithLink(rw http.ResponseWriter, req *http.Request, token string, dest string) error {
+	session, _ := a.authSession(req)
+	if session.Values["username"] != nil {
+		a.apiError(rw, http.StatusConflict, CodeAlreadyAuthenticated, "Already logged in.")
+		return ErrAlreadyAuthenticated
+	}
+	t, err := a.parseToken(tokenLogin, token)
+	if err != nil {
+		a.fail(rw, req, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired login link.")
+		return err
+	}
+	if err := a.checkLockout(req, t.Username); err != nil {
+		a.reportLockout(rw, req, err)
+		return err
+	}
+	user, err := a.backend.User(t.Username)
+	if err != nil && err != ErrMissingUser {
+		a.backendFailure(rw, err)
+		return backendError(err)
+	}
+	check := strings.SplitN(t.Check, ":", 2)
+	if err == ErrMissingUser || user.LoginNonce == "" || len(check) != 2 || check[1] != user.Email ||
+		subtle.ConstantTimeCompare([]byte(user.LoginNonce), []byte(hashNonce(check[0]))) != 1 {
+		a.fail(rw, req, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired login link.")
+		return ErrInvalidToken
+	}
+	user.LoginNonce = ""
+	user.EmailVerified = true
+	if err := a.backend.SaveUser(user); err != nil {
+		a.backendFailure(rw, err)
+		return backendError(err)
+	}
+	if user.TOTPEnabled {
+		a.startPendingLogin(rw, req, session, user.Username)
+		a.apiError(rw, http.StatusUnauthorized, CodeSecondFactorRequired, "Enter the code from your authenticator app.")
+		return ErrSecondFactorRequired
+	}
+	a.resetFailures(user.Username)
+	a.finishLogin(rw, req, session, user, dest)
+	return nil
+}
+
+// hashNonce returns the stored form of a login link nonce.
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoginWithLink(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, LoginURL: "https://example.com/magic"})
+
+	if err := auth.SendLoginLink("nobody@example.com"); err != nil {
+		t.Fatalf("SendLoginLink: unknown address revealed: %v", err)
+	}
+	auth.SendLoginLink("user@example.com")
+	if sent := waitForMail(t, mailer, 1); len(sent) != 1 || sent[0].To != "user@example.com" {
+		t.Fatalf("SendLoginLink: expected one email to user@example.com, got %+v", sent)
+	}
+	old := mailToken(t, mailer, "user@example.com")
+	if err := auth.SendLoginLink("user@example.com"); err != nil {
+		t.Fatalf("SendLoginLink: %v", err)
+	}
+	waitForMail(t, mailer, 2)
+	token := mailToken(t, mailer, "user@example.com")
+	if err := auth.LoginWithLink(httptest.NewRecorder(), newTestRequest("GET", nil), old, "/"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("LoginWithLink: expected ErrInvalidToken for replaced link, got %v", err)
+	}
+
+	// Visiting a protected page first saves it in the redirects session.
+	rw := httptest.NewRecorder()
+	auth.Authorize(rw, newTestRequest("GET", nil), true)
+	rw2 := httptest.NewRecorder()
+	if err := auth.LoginWithLink(rw2, newTestRequest("GET", rw.Result().Cookies()), token, "/"); err != nil {
+		t.Fatalf("LoginWithLink: %v", err)
+	}
+	if loc := rw2.Header().Get("Location"); loc != "/private" {
+		t.Fatalf("LoginWithLink: expected redirect to /private, got %v", loc)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", rw2.Result().Cookies()), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if user, _ := auth.backend.User("user"); !user.EmailVerified || user.LoginNonce != "" {
+		t.Fatalf("LoginWithLink: user not updated: %+v", user)
+	}
+	if err := auth.LoginWithLink(httptest.NewRecorder(), newTestRequest("GET", nil), token, "/"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("LoginWithLink: expected ErrInvalidToken for used link, got %v", err)
+	}
+}
+
+func TestLoginWithLinkSecondFactor(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, LoginURL: "/magic"})
+	secret, _ := enableTOTP(t, auth, "user")
+
+	auth.SendLoginLink("user@example.com")
+	waitForMail(t, mailer, 1)
+	rw := httptest.NewRecorder()
+	err := auth.LoginWithLink(rw, newTestRequest("GET", nil), mailToken(t, mailer, "user@example.com"), "/")
+	if !errors.Is(err, ErrSecondFactorRequired) {
+		t.Fatalf("LoginWithLink: expected ErrSecondFactorRequired, got %v", err)
+	}
+	if err := auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", rw.Result().Cookies()), nextTOTP(t, auth, "user", secret), ""); err != nil {
+		t.Fatalf("VerifySecondFactor: %v", err)
+	}
+}
+
+func TestLoginWithLinkEmailChanged(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, LoginURL: "/magic"})
+
+	auth.SendLoginLink("user@example.com")
+	waitForMail(t, mailer, 1)
+	user, _ := auth.backend.User("user")
+	user.Email = "other@example.com"
+	auth.backend.SaveUser(user)
+	err := auth.LoginWithLink(httptest.NewRecorder(), newTestRequest("GET", nil), mailToken(t, mailer, "user@example.com"), "/")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("LoginWithLink: expected ErrInvalidToken after email change, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package httpauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	environmentContextKey
+)
+
+// UserFromContext returns the user stored in a request context. Handlers
+// wrapped with RequireLogin, RequireRole and RequirePermission get a request
+// carrying the user that was authorized, as they were at the time, which
+// Authorize, AuthorizeRole and CurrentUser reuse instead of looking them up
+// again. The boolean is false if no user was stored.
+func UserFromContext(ctx context.Context) (UserData, bool) {
+	user, ok := ctx.Value(userContextKey).(UserData)
+	return user, ok
+}
+
+// withUser returns a copy of req carrying user in its context.
+func withUser(req *http.Request, user UserData) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+}
+
+// withoutUser returns a copy of req without a user in its context, or req if
+// it has none.
+func withoutUser(req *http.Request) *http.Request {
+	if _, ok := UserFromContext(req.Context()); !ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), userContextKey, nil))
+}
+
+// SetLoginURL sets the location browsers are redirected to by the RequireLogin
+// and RequireRole middleware when they aren't allowed through. Defaults to
+// "/login".
+func (a *Authorizer) SetLoginURL(url string) {
+	a.loginURL = url
+}
+
+// RequireLogin wraps a handler so it is only called for logged in users.
+//
+// Browser page loads (GET or HEAD requests accepting text/html) that fail
+// authorization are saved for a redirect after login, given a message, and
+// redirected to the login URL. Other requests receive a 401 Unauthorized.
+//
+// In API mode requests are never redirected and failures are written as JSON
+// errors.
+//
+// The logged in user is added to the request's context and can be retrieved
+// with UserFromContext.
+func (a Authorizer) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		browser := !a.apiMode && isBrowserRequest(req)
+		authed, _, err := a.authorize(rw, req, browser || a.apiMode)
+		if err != nil {
+			a.deny(rw, req, browser, http.StatusUnauthorized)
+			return
+		}
+		serveWithEnvironment(rw, authed, next)
+	})
+}
+
+// RequireRole wraps a handler so it is only called for logged in users with a
+// role at least as high as the given one. Failures are handled like
+// RequireLogin, except that logged in users without a high enough role receive
+// a 403 Forbidden instead of a 401.
+func (a Authorizer) RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		browser := !a.apiMode && isBrowserRequest(req)
+		authed, err := a.authorizeRole(rw, req, role, browser || a.apiMode)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrInsufficientRole) {
+				status = http.StatusForbidden
+			}
+			a.deny(rw, req, browser, status)
+			return
+		}
+		serveWithEnvironment(rw, authed, next)
+	})
+}
+
+// RequirePermission wraps a handler so it is only called for logged in users
+// whose role grants the given permission. Failures are handled like
+// RequireRole.
+func (a Authorizer) RequirePermission(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		browser := !a.apiMode && isBrowserRequest(req)
+		authed, err := a.authorizePermission(rw, req, permission, browser || a.apiMode)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrPermissionDenied) {
+				status = http.StatusForbidden
+			}
+			a.deny(rw, req, browser, status)
+			return
+		}
+		serveWithEnvironment(rw, authed, next)
+	})
+}
+
+// serveWithEnvironment adds the request's environment (see Can) to its
+// context and calls next.
+func serveWithEnvironment(rw http.ResponseWriter, req *http.Request, next http.Handler) {
+	next.ServeHTTP(rw, req.WithContext(ContextWithEnvironment(req.Context(), RequestEnvironment(req))))
+}
+
+// deny rejects a request, redirecting browsers to the login page and
+// responding with the given status code otherwise. In API mode the response
+// has already been written by Authorize or AuthorizeRole.
+func (a Authorizer) deny(rw http.ResponseWriter, req *http.Request, browser bool, status int) {
+	if a.apiMode {
+		return
+	}
+	if browser {
+		http.Redirect(rw, req, a.loginURL, http.StatusSeeOther)
+		return
+	}
+	http.Error(rw, http.StatusText(status), status)
+}
+
+// isBrowserRequest reports whether a request looks like a page load that can
+// be answered with a redirect.
+func isBrowserRequest(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
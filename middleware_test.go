@@ -0,0 +1,195 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestAuthorizer returns an Authorizer backed by a fresh gob file with a
+// "user" and an "admin" account, both using the password "password".
+func newTestAuthorizer(t *testing.T) Authorizer {
+	path := filepath.Join(t.TempDir(), "auth.gob")
+	if _, err := os.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewGobFileAuthBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := make(map[string]Role)
+	roles["user"] = 40
+	roles["admin"] = 80
+	auth, err := NewAuthorizer(backend, []byte("testkey"), "user", roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/", nil)
+	for _, u := range []UserData{
+		{Username: "user", Email: "user@example.com"},
+		{Username: "admin", Email: "admin@example.com", Role: "admin"},
+	} {
+		if err := auth.Register(httptest.NewRecorder(), req, u, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return auth
+}
+
+// loginCookies logs a user in and returns the cookies that were set.
+func loginCookies(t *testing.T, auth Authorizer, username string) []*http.Cookie {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, username, "password", ""); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return rw.Result().Cookies()
+}
+
+func newTestRequest(method string, cookies []*http.Cookie) *http.Request {
+	req, _ := http.NewRequest(method, "/private", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func userHandler(t *testing.T, called *bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		*called = true
+		if _, ok := UserFromContext(req.Context()); !ok {
+			t.Error("UserFromContext: no user in context")
+		}
+	})
+}
+
+func TestRequireLogin(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	var called bool
+	h := auth.RequireLogin(userHandler(t, &called))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, newTestRequest("GET", nil))
+	if called || rw.Code != http.StatusUnauthorized {
+		t.Fatalf("RequireLogin: expected 401, got %v", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req := newTestRequest("GET", nil)
+	req.Header.Set("Accept", "text/html")
+	h.ServeHTTP(rw, req)
+	if called || rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/login" {
+		t.Fatalf("RequireLogin: expected redirect to /login, got %v %v", rw.Code, rw.Header().Get("Location"))
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, newTestRequest("GET", loginCookies(t, auth, "user")))
+	if !called || rw.Code != http.StatusOK {
+		t.Fatalf("RequireLogin: logged in user rejected with %v", rw.Code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	var called bool
+	h := auth.RequireRole("admin", userHandler(t, &called))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, newTestRequest("POST", nil))
+	if called || rw.Code != http.StatusUnauthorized {
+		t.Fatalf("RequireRole: expected 401, got %v", rw.Code)
+	}
+
+	cookies := loginCookies(t, auth, "user")
+	lookups := 0
+	backend := auth.backend
+	auth.backend = countingBackend{backend, &lookups}
+	h = auth.RequireRole("admin", userHandler(t, &called))
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, newTestRequest("POST", cookies))
+	if called || rw.Code != http.StatusForbidden {
+		t.Fatalf("RequireRole: expected 403, got %v", rw.Code)
+	}
+	if lookups != 1 {
+		t.Fatalf("RequireRole: expected 1 backend lookup, got %d", lookups)
+	}
+	auth.backend = backend
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, newTestRequest("POST", loginCookies(t, auth, "admin")))
+	if !called || rw.Code != http.StatusOK {
+		t.Fatalf("RequireRole: admin rejected with %v", rw.Code)
+	}
+}
+
+// countingBackend counts calls to User.
+type countingBackend struct {
+	AuthBackend
+	lookups *int
+}
+
+func (b countingBackend) User(username string) (UserData, error) {
+	*b.lookups++
+	return b.AuthBackend.User(username)
+}
+
+func TestUserLookupCached(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	cookies := loginCookies(t, auth, "admin")
+	lookups := 0
+	auth.backend = countingBackend{auth.backend, &lookups}
+
+	called := false
+	h := auth.RequireRole("admin", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+		if cached, ok := UserFromContext(req.Context()); !ok || cached.Username != "admin" {
+			t.Fatal("UserFromContext: user not passed to the handler")
+		}
+		if err := auth.AuthorizeRole(rw, req, "admin", false); err != nil {
+			t.Fatalf("AuthorizeRole: %v", err)
+		}
+		user, err := auth.CurrentUser(rw, req)
+		if err != nil || user.Username != "admin" {
+			t.Fatalf("CurrentUser: %v %v", user.Username, err)
+		}
+	}))
+	req := newTestRequest("GET", cookies)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !called {
+		t.Fatal("RequireRole: handler not called")
+	}
+	if lookups != 1 {
+		t.Fatalf("Expected 1 backend lookup, got %d", lookups)
+	}
+	if _, ok := UserFromContext(req.Context()); ok {
+		t.Fatal("RequireRole: modified the caller's request")
+	}
+}
+
+func TestRevokedUserNotCached(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	if err := auth.SetPolicy(&Policy{Rules: []PolicyRule{{Name: "admins", Effect: PolicyAllow, Actions: []string{"*"}, Role: "admin"}}}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	cookies := loginCookies(t, auth, "admin")
+	if err := auth.LogoutAll("admin"); err != nil {
+		t.Fatalf("LogoutAll: %v", err)
+	}
+
+	req := newTestRequest("GET", cookies)
+	if err := auth.Authorize(httptest.NewRecorder(), req, false); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("Authorize: expected ErrSessionRevoked, got %v", err)
+	}
+	if _, ok := UserFromContext(req.Context()); ok {
+		t.Fatal("UserFromContext: revoked user stored in request")
+	}
+	if d := auth.Can(req.Context(), "users:ban", Resource{Type: "user"}); d.Allowed {
+		t.Fatalf("Can: allowed for revoked user: %v", d)
+	}
+	if _, err := auth.CurrentUser(httptest.NewRecorder(), req); err == nil {
+		t.Fatal("CurrentUser: revoked user returned")
+	}
+}
@@ -0,0 +1,204 @@
+package httpauth
+
+import (
+	"fmt"
+
+	"github.com/gorilla/sessions"
+)
+
+// Option configures an Authorizer made by NewAuthorizerWithOptions.
+type Option func(*authorizerOptions)
+
+type authorizerOptions struct {
+	keys        []KeyPair
+	defaultRole string
+	roles       []RoleDefinition
+	setup       []func(*Authorizer) error
+}
+
+// then adds a step run on the Authorizer once it is set up.
+func (o *authorizerOptions) then(f func(*Authorizer) error) {
+	o.setup = append(o.setup, f)
+}
+
+// WithKey sets the key used to sign cookies and tokens. See NewAuthorizer.
+func WithKey(key []byte) Option {
+	return WithKeys(KeyPair{Hash: key})
+}
+
+// WithKeys sets the key pairs used to sign and encrypt cookies and tokens.
+// See NewAuthorizerWithKeys.
+func WithKeys(keys ...KeyPair) Option {
+	return func(o *authorizerOptions) { o.keys = keys }
+}
+
+// WithRoles sets the roles users can have, and the one new users get. See
+// NewAuthorizer.
+func WithRoles(defaultRole string, roles map[string]Role) Option {
+	var defs []RoleDefinition
+	for name, level := range roles {
+		defs = append(defs, RoleDefinition{Name: name, Level: level})
+	}
+	return WithRoleDefinitions(defaultRole, defs...)
+}
+
+// WithRoleDefinitions is like WithRoles, but also sets the permissions of
+// roles and which roles they inherit. See AuthorizePermission.
+func WithRoleDefinitions(defaultRole string, roles ...RoleDefinition) Option {
+	return func(o *authorizerOptions) {
+		o.defaultRole = defaultRole
+		o.roles = roles
+	}
+}
+
+// WithPasswordHasher sets the hasher for new passwords. See SetPasswordHasher.
+func WithPasswordHasher(h PasswordHasher) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetPasswordHasher(h); return nil })
+	}
+}
+
+// WithSessionStore keeps sessions server side. See SetSessionStore.
+func WithSessionStore(store SessionStore) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetSessionStore(store); return nil })
+	}
+}
+
+// WithCookieOptions sets cookie names and attributes. See SetCookieOptions.
+func WithCookieOptions(opts CookieOptions) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { return a.SetCookieOptions(opts) })
+	}
+}
+
+// WithLockout enables locking accounts after failed logins. See SetLockout.
+func WithLockout(policy LockoutPolicy, store FailureStore) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetLockout(policy, store); return nil })
+	}
+}
+
+// WithSessionTimeouts sets session timeouts. See SetSessionTimeouts.
+func WithSessionTimeouts(timeouts SessionTimeouts, roles map[string]SessionTimeouts) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetSessionTimeouts(timeouts, roles); return nil })
+	}
+}
+
+// WithCSRFOptions configures CSRF tokens. See SetCSRFOptions.
+func WithCSRFOptions(opts CSRFOptions) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { return a.SetCSRFOptions(opts) })
+	}
+}
+
+// WithPolicy sets the access policy used by Can. See SetPolicy.
+func WithPolicy(p *Policy) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { return a.SetPolicy(p) })
+	}
+}
+
+// WithEmailConfig configures sending emails. See SetEmailConfig.
+func WithEmailConfig(config EmailConfig) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetEmailConfig(config); return nil })
+	}
+}
+
+// WithAPIMode switches the Authorizer to API mode. See SetAPIMode.
+func WithAPIMode() Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetAPIMode(true); return nil })
+	}
+}
+
+// WithLoginURL sets where the middleware redirects browsers. See SetLoginURL.
+func WithLoginURL(url string) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetLoginURL(url); return nil })
+	}
+}
+
+// WithRedirectHosts sets the hosts Login may redirect to. See
+// SetRedirectHosts.
+func WithRedirectHosts(hosts ...string) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetRedirectHosts(hosts...); return nil })
+	}
+}
+
+// WithLogger sets a logger for errors that can't be returned to the caller.
+// See SetLogger.
+func WithLogger(l Logger) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetLogger(l); return nil })
+	}
+}
+
+// WithEventHook adds a function called for authentication events. See
+// AddEventHook.
+func WithEventHook(hook func(Event)) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.AddEventHook(hook); return nil })
+	}
+}
+
+// WithMessageCatalog replaces the messages shown to users. See
+// SetMessageCatalog.
+func WithMessageCatalog(catalog MessageCatalog) Option {
+	return func(o *authorizerOptions) {
+		o.then(func(a *Authorizer) error { a.SetMessageCatalog(catalog); return nil })
+	}
+}
+
+// NewAuthorizerWithOptions returns a new Authorizer for backend, configured by
+// opts. WithKey or WithKeys and WithRoles are required; everything else has
+// the same defaults as NewAuthorizer. Options are applied in order.
+func NewAuthorizerWithOptions(backend AuthBackend, opts ...Option) (Authorizer, error) {
+	var a Authorizer
+	var o authorizerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.keys) == 0 {
+		return a, mkerror("no keys given")
+	}
+	var pairs [][]byte
+	for i, k := range o.keys {
+		if len(k.Hash) == 0 {
+			return a, fmt.Errorf("httpauth: key pair %d has no hash key", i)
+		}
+		switch len(k.Block) {
+		case 0, 16, 24, 32:
+		default:
+			return a, fmt.Errorf("httpauth: key pair %d has a block key of %d bytes, not 16, 24 or 32", i, len(k.Block))
+		}
+		pairs = append(pairs, k.Hash, k.Block)
+	}
+	a.cookies = DefaultCookieOptions()
+	a.cookiejar = sessions.NewCookieStore(pairs...)
+	*a.cookiejar.Options = a.cookies.Auth.options()
+	a.messageStore = newCookieStore(a.cookiejar.Codecs, a.cookies.Messages)
+	a.redirectStore = newCookieStore(a.cookiejar.Codecs, a.cookies.Redirects)
+	a.tokens = tokenCodecs(pairs...)
+	a.authStore = a.cookiejar
+	a.backend = backend
+	a.loginURL = "/login"
+	a.hasher = BcryptHasher{}
+	a.csrf = DefaultCSRFOptions()
+	a.locks = newKeyedMutex()
+	for _, f := range o.setup {
+		if err := f(&a); err != nil {
+			return a, err
+		}
+	}
+	if err := a.loadRoles(o.defaultRole, o.roles); err != nil {
+		return a, err
+	}
+	if _, ok := a.roles.level(o.defaultRole); !ok {
+		return a, fmt.Errorf("%w: default role %q", ErrRoleNotFound, o.defaultRole)
+	}
+	return a, nil
+}
@@ -0,0 +1,100 @@
+package httpauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokenFailureStore is a FailureStore that can't save anything.
+type brokenFailureStore struct {
+	*MemoryFailureStore
+}
+
+func (s brokenFailureStore) SaveFailures(key string, r FailureRecord) error {
+	return errTestBackend
+}
+
+func TestNewAuthorizerWithOptions(t *testing.T) {
+	base := newTestAuthorizer(t)
+	var events []Event
+	var logs bytes.Buffer
+	auth, err := NewAuthorizerWithOptions(base.backend,
+		WithKey([]byte("testkey")),
+		WithRoles("user", base.Roles()),
+		WithPasswordHasher(ScryptHasher{}),
+		WithCookieOptions(CookieOptions{Auth: CookieConfig{Name: "app-auth"}}),
+		WithLockout(LockoutPolicy{MaxFailures: 5, Window: time.Minute, Duration: time.Minute}, brokenFailureStore{NewMemoryFailureStore()}),
+		WithLogger(log.New(&logs, "", 0)),
+		WithEventHook(func(e Event) { events = append(events, e) }),
+		WithMessageCatalog(MessageCatalog{CodeBadCredentials: "Falscher Benutzername oder falsches Passwort."}),
+		WithAPIMode(),
+	)
+	if err != nil {
+		t.Fatalf("NewAuthorizerWithOptions: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "/register", nil)
+	if err := auth.Register(httptest.NewRecorder(), req, UserData{Username: "new", Email: "new@example.com"}, "password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if user, _ := auth.backend.User("new"); hashAlgorithm(user.Hash) != "scrypt" {
+		t.Fatalf("Register: hashed with %v, not scrypt", hashAlgorithm(user.Hash))
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", nil)
+	auth.Login(rw, req, "new", "wrongpassword", "")
+	var body struct{ Error APIError }
+	json.NewDecoder(rw.Body).Decode(&body)
+	if body.Error.Message != "Falscher Benutzername oder falsches Passwort." {
+		t.Fatalf("Login: message not from catalog: %+v", body.Error)
+	}
+	if !strings.Contains(logs.String(), "new") {
+		t.Fatalf("Login: failure store error not logged: %q", logs.String())
+	}
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, "new", "password", ""); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if c := rw.Result().Cookies(); len(c) != 1 || c[0].Name != "app-auth" {
+		t.Fatalf("Login: wrong cookies %v", c)
+	}
+
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+		if e.Username != "new" || e.Time.IsZero() {
+			t.Errorf("Event %v: wrong user or time: %+v", e.Type, e)
+		}
+	}
+	if len(types) != 3 || types[0] != EventRegister || types[1] != EventLoginFailed || types[2] != EventLogin {
+		t.Fatalf("Events: expected register, login_failed and login, got %v", types)
+	}
+	if events[1].Err != ErrBadCredentials {
+		t.Fatalf("Events: expected ErrBadCredentials for failed login, got %v", events[1].Err)
+	}
+}
+
+func TestNewAuthorizerWithOptionsErrors(t *testing.T) {
+	backend := newTestAuthorizer(t).backend
+	roles := map[string]Role{"user": 1}
+	for name, opts := range map[string][]Option{
+		"no keys":      {WithRoles("user", roles)},
+		"no roles":     {WithKey([]byte("key"))},
+		"bad role":     {WithKey([]byte("key")), WithRoles("root", roles)},
+		"bad cookie":   {WithKey([]byte("key")), WithRoles("user", roles), WithCookieOptions(CookieOptions{Auth: CookieConfig{Name: "__Host-auth"}})},
+		"bad key pair": {WithKeys(KeyPair{Hash: []byte("key"), Block: []byte("key")}), WithRoles("user", roles)},
+	} {
+		if _, err := NewAuthorizerWithOptions(backend, opts...); err == nil {
+			t.Errorf("NewAuthorizerWithOptions with %v: no error", name)
+		}
+	}
+}
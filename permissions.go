@@ -0,0 +1,169 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrPermissionDenied matches the *PermissionError returned by
+// AuthorizePermission.
+var ErrPermissionDenied = mkerror("permission denied")
+
+// PermissionError is returned when a user's roles don't grant a permission.
+// It matches ErrPermissionDenied.
+type PermissionError struct {
+	Username   string
+	Permission string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("httpauth: user %q lacks permission %q", e.Username, e.Permission)
+}
+
+// Is reports whether target is ErrPermissionDenied.
+func (e *PermissionError) Is(target error) bool {
+	return target == ErrPermissionDenied
+}
+
+// GrantPermission lets users with the given role, or with roles inheriting
+// it, use a permission. Permissions are names like "users:ban", without
+// commas or spaces.
+func (a Authorizer) GrantPermission(role string, permission string) error {
+	if err := validPermission(permission); err != nil {
+		return err
+	}
+	return a.updateRole(role, func(r *RoleDefinition) error {
+		if !containsString(r.Permissions, permission) {
+			r.Permissions = append(append([]string(nil), r.Permissions...), permission)
+		}
+		return nil
+	})
+}
+
+// RevokePermission takes a permission away from a role. Users may still have
+// it through other roles.
+func (a Authorizer) RevokePermission(role string, permission string) error {
+	return a.updateRole(role, func(r *RoleDefinition) error {
+		var kept []string
+		for _, p := range r.Permissions {
+			if p != permission {
+				kept = append(kept, p)
+			}
+		}
+		r.Permissions = kept
+		return nil
+	})
+}
+
+// SetInheritedRoles makes role grant all permissions of the parent roles,
+// replacing the roles it inherited before. Inheritance only concerns
+// permissions; levels and AuthorizeRole are unaffected. Returns
+// ErrRoleNotFound for unknown roles and ErrInvalidRole if role would end up
+// inheriting from itself.
+func (a Authorizer) SetInheritedRoles(role string, parents ...string) error {
+	return a.updateRole(role, func(r *RoleDefinition) error {
+		for _, parent := range parents {
+			if _, ok := a.roles.defs[parent]; !ok {
+				return fmt.Errorf("%w: %q", ErrRoleNotFound, parent)
+			}
+			if parent == role || a.roles.inherits(parent, role, map[string]bool{}) {
+				return fmt.Errorf("%w: %q would inherit from itself", ErrInvalidRole, role)
+			}
+		}
+		r.Inherits = append([]string(nil), parents...)
+		return nil
+	})
+}
+
+// Permissions returns the permissions users with the given role have,
+// including inherited ones, sorted.
+func (a Authorizer) Permissions(role string) ([]string, error) {
+	a.roles.mu.RLock()
+	defer a.roles.mu.RUnlock()
+	if _, ok := a.roles.defs[role]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrRoleNotFound, role)
+	}
+	set := make(map[string]bool)
+	a.roles.collect([]string{role}, set, map[string]bool{})
+	permissions := make([]string, 0, len(set))
+	for p := range set {
+		permissions = append(permissions, p)
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+// AuthorizePermission runs Authorize on a user, then makes sure one of their
+// roles, held directly or through a group, grants the given permission,
+// returning a *PermissionError if not. Messages and JSON errors are written
+// like AuthorizeRole does with redirectWithMessage unset.
+func (a Authorizer) AuthorizePermission(rw http.ResponseWriter, req *http.Request, permission string) error {
+	_, err := a.authorizePermission(rw, req, permission, false)
+	return err
+}
+
+// authorizePermission does the work of AuthorizePermission, returning a copy
+// of req like authorize does.
+func (a Authorizer) authorizePermission(rw http.ResponseWriter, req *http.Request, permission string, redirectWithMessage bool) (*http.Request, error) {
+	authed, user, err := a.authorize(rw, req, redirectWithMessage)
+	if err != nil {
+		return authed, err
+	}
+	if a.roles.hasPermission(a.roles.userRoles(user), permission) {
+		return authed, nil
+	}
+	a.addMessage(rw, req, a.text(CodePermissionDenied, "You don't have permission to do that."))
+	if redirectWithMessage {
+		a.apiError(rw, http.StatusForbidden, CodePermissionDenied, "You don't have permission to do that.")
+	}
+	return withoutUser(req), &PermissionError{user.Username, permission}
+}
+
+// hasPermission reports whether any of the named roles grants permission.
+func (s *roleSet) hasPermission(roles []string, permission string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	set := make(map[string]bool)
+	s.collect(roles, set, map[string]bool{})
+	return set[permission]
+}
+
+// collect adds the permissions of the named roles and the roles they inherit
+// to set. The caller holds the lock.
+func (s *roleSet) collect(roles []string, set map[string]bool, seen map[string]bool) {
+	for _, name := range roles {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		r := s.defs[name]
+		for _, p := range r.Permissions {
+			set[p] = true
+		}
+		s.collect(r.Inherits, set, seen)
+	}
+}
+
+// inherits reports whether role from inherits target, directly or not. The
+// caller holds the lock.
+func (s *roleSet) inherits(from string, target string, seen map[string]bool) bool {
+	if seen[from] {
+		return false
+	}
+	seen[from] = true
+	for _, parent := range s.defs[from].Inherits {
+		if parent == target || s.inherits(parent, target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func validPermission(permission string) error {
+	if permission == "" || strings.ContainsAny(permission, ", \t\r\n") {
+		return fmt.Errorf("httpauth: invalid permission %q", permission)
+	}
+	return nil
+}
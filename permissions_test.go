@@ -0,0 +1,126 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	if err := auth.AddRole("moderator", 60); err != nil {
+		t.Fatalf("AddRole: %v", err)
+	}
+	for _, g := range []struct{ role, permission string }{
+		{"user", "posts:write"},
+		{"moderator", "users:ban"},
+		{"admin", "billing:edit"},
+	} {
+		if err := auth.GrantPermission(g.role, g.permission); err != nil {
+			t.Fatalf("GrantPermission: %v", err)
+		}
+	}
+	if err := auth.GrantPermission("user", "bad permission"); err == nil {
+		t.Fatal("GrantPermission: invalid permission accepted")
+	}
+	if err := auth.SetInheritedRoles("moderator", "user"); err != nil {
+		t.Fatalf("SetInheritedRoles: %v", err)
+	}
+	if err := auth.SetInheritedRoles("admin", "moderator"); err != nil {
+		t.Fatalf("SetInheritedRoles: %v", err)
+	}
+	if err := auth.SetInheritedRoles("user", "admin"); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("SetInheritedRoles: expected ErrInvalidRole for a cycle, got %v", err)
+	}
+	if err := auth.SetInheritedRoles("user", "nobody"); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("SetInheritedRoles: expected ErrRoleNotFound, got %v", err)
+	}
+
+	perms, err := auth.Permissions("admin")
+	if err != nil {
+		t.Fatalf("Permissions: %v", err)
+	}
+	if want := []string{"billing:edit", "posts:write", "users:ban"}; !reflect.DeepEqual(perms, want) {
+		t.Fatalf("Permissions: expected %v, got %v", want, perms)
+	}
+
+	if err := auth.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "moderator"); err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	moderator := loginCookies(t, auth, "user")
+	for permission, allowed := range map[string]bool{
+		"posts:write":  true,
+		"users:ban":    true,
+		"billing:edit": false,
+		"unknown":      false,
+	} {
+		err := auth.AuthorizePermission(httptest.NewRecorder(), newTestRequest("GET", moderator), permission)
+		if allowed && err != nil {
+			t.Errorf("AuthorizePermission(%q): %v", permission, err)
+		}
+		var perr *PermissionError
+		if !allowed && (!errors.As(err, &perr) || perr.Permission != permission) {
+			t.Errorf("AuthorizePermission(%q): expected *PermissionError, got %v", permission, err)
+		}
+	}
+	if err := auth.AuthorizePermission(httptest.NewRecorder(), newTestRequest("GET", nil), "posts:write"); err != ErrNotLoggedIn {
+		t.Fatalf("AuthorizePermission: expected ErrNotLoggedIn, got %v", err)
+	}
+
+	// Levels still decide AuthorizeRole.
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", moderator), "admin", false); !errors.Is(err, ErrInsufficientRole) {
+		t.Fatalf("AuthorizeRole: expected ErrInsufficientRole, got %v", err)
+	}
+
+	if err := auth.RevokePermission("moderator", "users:ban"); err != nil {
+		t.Fatalf("RevokePermission: %v", err)
+	}
+	rw := httptest.NewRecorder()
+	if err := auth.AuthorizePermission(rw, newTestRequest("GET", moderator), "users:ban"); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("AuthorizePermission: revoked permission granted: %v", err)
+	}
+	if messages := auth.Messages(httptest.NewRecorder(), newTestRequest("GET", rw.Result().Cookies())); len(messages) != 1 {
+		t.Fatalf("AuthorizePermission: expected a message, got %v", messages)
+	}
+
+	if err := auth.RenameRole("moderator", "mod"); err != nil {
+		t.Fatalf("RenameRole: %v", err)
+	}
+	if perms, _ := auth.Permissions("admin"); !reflect.DeepEqual(perms, []string{"billing:edit", "posts:write"}) {
+		t.Fatalf("RenameRole: inheritance lost, admin has %v", perms)
+	}
+	var inUse *RoleInUseError
+	if err := auth.DeleteRole("mod"); !errors.As(err, &inUse) || !reflect.DeepEqual(inUse.Roles, []string{"admin"}) {
+		t.Fatalf("DeleteRole: expected *RoleInUseError for inheriting role, got %v", err)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.GrantPermission("admin", "users:ban")
+	var called bool
+	h := auth.RequirePermission("users:ban", userHandler(t, &called))
+
+	for _, c := range []struct {
+		cookies []*http.Cookie
+		code    int
+	}{
+		{nil, http.StatusUnauthorized},
+		{loginCookies(t, auth, "user"), http.StatusForbidden},
+		{loginCookies(t, auth, "admin"), http.StatusOK},
+	} {
+		called = false
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, newTestRequest("POST", c.cookies))
+		if rw.Code != c.code || called != (c.code == http.StatusOK) {
+			t.Fatalf("RequirePermission: expected %d, got %d (handler called: %v)", c.code, rw.Code, called)
+		}
+	}
+
+	auth.SetAPIMode(true)
+	rw := httptest.NewRecorder()
+	auth.RequirePermission("users:ban", userHandler(t, &called)).ServeHTTP(rw, newTestRequest("POST", loginCookies(t, auth, "user")))
+	checkAPIError(t, rw, http.StatusForbidden, CodePermissionDenied)
+}
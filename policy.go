@@ -0,0 +1,567 @@
+package httpauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ErrInvalidPolicy is returned when a policy can't be parsed or one of its
+// rules is malformed.
+var ErrInvalidPolicy = mkerror("invalid policy")
+
+// Effects of policy rules.
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// Policy is a list of rules deciding which actions users may take on which
+// resources; see Can. It is usually loaded from a file with LoadPolicyFile:
+//
+//	rules:
+//	  - name: editors-edit-own-posts-at-the-office
+//	    effect: allow
+//	    actions: ["posts:edit"]
+//	    resources: ["post"]
+//	    role: editor
+//	    conditions:
+//	      - {attribute: resource.owner, op: eq, ref: subject.username}
+//	      - {attribute: env.ip, op: cidr, values: ["10.0.0.0/8"]}
+//	      - {attribute: env.time, op: between, values: ["08:00", "18:00"]}
+//
+// A rule applies when the action and resource type match one of its patterns,
+// the user has at least its Role (as with AuthorizeRole) and all conditions
+// hold. Deny rules that apply win over allow rules, and actions no rule allows
+// are denied.
+type Policy struct {
+	Rules []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// PolicyRule is a rule of a Policy. Actions and Resources are patterns as
+// understood by path.Match, so "posts:*" matches every posts action; no
+// Resources matches any resource.
+type PolicyRule struct {
+	Name       string            `json:"name" yaml:"name"`
+	Effect     string            `json:"effect" yaml:"effect"`
+	Actions    []string          `json:"actions" yaml:"actions"`
+	Resources  []string          `json:"resources,omitempty" yaml:"resources,omitempty"`
+	Role       string            `json:"role,omitempty" yaml:"role,omitempty"`
+	Conditions []PolicyCondition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+// PolicyCondition compares an attribute with Value, Values or the attribute
+// named by Ref. Attributes are:
+//
+//	action
+//	subject.username, subject.email, subject.email_verified, subject.role,
+//	subject.roles, subject.groups, subject.level, subject.attributes.<key>
+//	resource.type, resource.id, resource.owner, resource.attributes.<key>
+//	env.ip, env.time, env.weekday
+//
+// subject.roles includes roles held through groups, and subject.level is the
+// highest of their levels. env.time is formatted as RFC 3339 and env.weekday
+// as "Monday".
+//
+// Attributes can have several values, and Op is one of:
+//
+//	eq, in       some value equals an operand
+//	ne, not_in   no value equals an operand
+//	gt, gte,     some value compares to an operand as a number
+//	lt, lte
+//	cidr         some value is an IP address in one of the networks in Values
+//	between      some value is a time whose time of day lies between the two
+//	             "15:04" times in Values, which may wrap around midnight
+//	exists       the attribute has a value
+type PolicyCondition struct {
+	Attribute string   `json:"attribute" yaml:"attribute"`
+	Op        string   `json:"op" yaml:"op"`
+	Value     string   `json:"value,omitempty" yaml:"value,omitempty"`
+	Values    []string `json:"values,omitempty" yaml:"values,omitempty"`
+	Ref       string   `json:"ref,omitempty" yaml:"ref,omitempty"`
+}
+
+// Resource is what an action is taken on, as seen by policy rules.
+type Resource struct {
+	Type       string
+	ID         string
+	Owner      string // username of the owner, if any
+	Attributes map[string]string
+}
+
+func (r Resource) String() string {
+	if r.ID == "" {
+		return r.Type
+	}
+	return r.Type + "/" + r.ID
+}
+
+// Environment holds the circumstances of a request that policy rules can
+// look at. A zero Time means the time Can is called.
+type Environment struct {
+	Time time.Time
+	IP   string
+}
+
+// RequestEnvironment returns the environment of a request: the current time
+// and the client's IP address. Like login throttling, it doesn't trust proxy
+// headers.
+func RequestEnvironment(req *http.Request) Environment {
+	return Environment{Time: time.Now(), IP: clientIP(req)}
+}
+
+// ContextWithEnvironment returns a copy of ctx carrying env, for Can.
+func ContextWithEnvironment(ctx context.Context, env Environment) context.Context {
+	return context.WithValue(ctx, environmentContextKey, env)
+}
+
+// Decision is the outcome of Can. Rule names the rule that decided, and is
+// empty if no rule allowed the action. Reason explains the decision,
+// including why allow rules for the action didn't apply.
+type Decision struct {
+	Allowed bool
+	Rule    string
+	Reason  string
+}
+
+func (d Decision) String() string {
+	return d.Reason
+}
+
+// ParsePolicy parses a policy written in YAML or JSON. It doesn't check the
+// rules; SetPolicy does.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	} else {
+		err = yaml.UnmarshalStrict(data, &p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	return &p, nil
+}
+
+// LoadPolicyFile reads a policy from a YAML or JSON file.
+func LoadPolicyFile(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("httpauth: reading policy: %w", err)
+	}
+	return ParsePolicy(data)
+}
+
+// SetPolicy checks and sets the policy used by Can, replacing the previous
+// one. A nil policy denies everything. Rules naming roles the Authorizer
+// doesn't know never apply.
+func (a *Authorizer) SetPolicy(p *Policy) error {
+	if p == nil {
+		a.policy = nil
+		return nil
+	}
+	compiled := make([]compiledRule, len(p.Rules))
+	for i, r := range p.Rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return fmt.Errorf("%w: rule %d: %v", ErrInvalidPolicy, i+1, err)
+		}
+		compiled[i] = c
+	}
+	a.policy = compiled
+	return nil
+}
+
+// SetUserAttributes replaces the attributes of username, which policy rules
+// see as subject.attributes.<key>. Returns ErrUserNotFound.
+func (a Authorizer) SetUserAttributes(username string, attributes map[string]string) error {
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
+		return backendError(err)
+	}
+	user.Attributes = attributes
+	if err := a.backend.SaveUser(user); err != nil {
+		return backendError(err)
+	}
+	return nil
+}
+
+// Can decides whether the user in ctx may take action on resource, according
+// to the policy set with SetPolicy.
+//
+// The user is the one the Authorizer stored in the request context (see
+// UserFromContext); without one, rules are evaluated for an anonymous user.
+// The environment is the one added with ContextWithEnvironment, which
+// handlers wrapped with RequireLogin, RequireRole and RequirePermission get.
+// For requests authorized otherwise, use
+//
+//	ctx := httpauth.ContextWithEnvironment(req.Context(), httpauth.RequestEnvironment(req))
+func (a Authorizer) Can(ctx context.Context, action string, resource Resource) Decision {
+	if a.policy == nil {
+		return Decision{Reason: "no policy set"}
+	}
+	in := policyInput{action: action, resource: resource}
+	in.user, _ = UserFromContext(ctx)
+	in.env, _ = ctx.Value(environmentContextKey).(Environment)
+	if in.env.Time.IsZero() {
+		in.env.Time = time.Now()
+	}
+	in.roles = a.roles.userRoles(in.user)
+	in.level = a.roles.maxLevel(in.roles)
+
+	var (
+		allow  *compiledRule
+		missed []string
+	)
+	for i := range a.policy {
+		r := &a.policy[i]
+		if !r.matches(action, resource.Type) {
+			continue
+		}
+		if why := r.unmet(a.roles, in); why != "" {
+			if r.Effect == PolicyAllow {
+				missed = append(missed, fmt.Sprintf("%q %s", r.Name, why))
+			}
+			continue
+		}
+		if r.Effect == PolicyDeny {
+			return Decision{false, r.Name, fmt.Sprintf("rule %q denies %s on %s", r.Name, action, resource)}
+		}
+		if allow == nil {
+			allow = r
+		}
+	}
+	if allow != nil {
+		return Decision{true, allow.Name, fmt.Sprintf("rule %q allows %s on %s", allow.Name, action, resource)}
+	}
+	reason := fmt.Sprintf("no rule allows %s on %s", action, resource)
+	if len(missed) > 0 {
+		reason += ": " + strings.Join(missed, "; ")
+	}
+	return Decision{Reason: reason}
+}
+
+type compiledRule struct {
+	PolicyRule
+	conditions []compiledCondition
+}
+
+type compiledCondition struct {
+	PolicyCondition
+	networks []*net.IPNet
+	from, to int // minutes after midnight, for between
+}
+
+func compileRule(r PolicyRule) (compiledRule, error) {
+	c := compiledRule{PolicyRule: r}
+	if r.Name == "" {
+		return c, fmt.Errorf("no name given")
+	}
+	if r.Effect != PolicyAllow && r.Effect != PolicyDeny {
+		return c, fmt.Errorf("%q: effect must be %q or %q", r.Name, PolicyAllow, PolicyDeny)
+	}
+	if len(r.Actions) == 0 {
+		return c, fmt.Errorf("%q: no actions given", r.Name)
+	}
+	for _, pattern := range append(append([]string(nil), r.Actions...), r.Resources...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return c, fmt.Errorf("%q: bad pattern %q", r.Name, pattern)
+		}
+	}
+	for _, cond := range r.Conditions {
+		cc, err := compileCondition(cond)
+		if err != nil {
+			return c, fmt.Errorf("%q: %v", r.Name, err)
+		}
+		c.conditions = append(c.conditions, cc)
+	}
+	return c, nil
+}
+
+func compileCondition(cond PolicyCondition) (compiledCondition, error) {
+	c := compiledCondition{PolicyCondition: cond}
+	if !validAttribute(cond.Attribute) {
+		return c, fmt.Errorf("unknown attribute %q", cond.Attribute)
+	}
+	if cond.Ref != "" && !validAttribute(cond.Ref) {
+		return c, fmt.Errorf("unknown attribute %q", cond.Ref)
+	}
+	hasOperand := cond.Ref != "" || cond.Value != "" || len(cond.Values) > 0
+	switch cond.Op {
+	case "eq", "in", "ne", "not_in":
+		if !hasOperand {
+			return c, fmt.Errorf("%s: %s needs a value", cond.Attribute, cond.Op)
+		}
+	case "gt", "gte", "lt", "lte":
+		if !hasOperand {
+			return c, fmt.Errorf("%s: %s needs a value", cond.Attribute, cond.Op)
+		}
+		for _, v := range append([]string{cond.Value}, cond.Values...) {
+			if _, err := strconv.ParseFloat(v, 64); cond.Ref == "" && v != "" && err != nil {
+				return c, fmt.Errorf("%s: %q isn't a number", cond.Attribute, v)
+			}
+		}
+	case "cidr":
+		for _, v := range append([]string{cond.Value}, cond.Values...) {
+			if v == "" {
+				continue
+			}
+			_, network, err := net.ParseCIDR(v)
+			if err != nil {
+				return c, fmt.Errorf("%s: %v", cond.Attribute, err)
+			}
+			c.networks = append(c.networks, network)
+		}
+		if len(c.networks) == 0 {
+			return c, fmt.Errorf("%s: cidr needs networks", cond.Attribute)
+		}
+	case "between":
+		if len(cond.Values) != 2 {
+			return c, fmt.Errorf("%s: between needs two times", cond.Attribute)
+		}
+		for i, v := range cond.Values {
+			t, err := time.Parse("15:04", v)
+			if err != nil {
+				return c, fmt.Errorf("%s: bad time %q", cond.Attribute, v)
+			}
+			m := t.Hour()*60 + t.Minute()
+			if i == 0 {
+				c.from = m
+			} else {
+				c.to = m
+			}
+		}
+	case "exists":
+	default:
+		return c, fmt.Errorf("%s: unknown op %q", cond.Attribute, cond.Op)
+	}
+	return c, nil
+}
+
+var policyAttributes = map[string]bool{
+	"action":                 true,
+	"subject.username":       true,
+	"subject.email":          true,
+	"subject.email_verified": true,
+	"subject.role":           true,
+	"subject.roles":          true,
+	"subject.groups":         true,
+	"subject.level":          true,
+	"resource.type":          true,
+	"resource.id":            true,
+	"resource.owner":         true,
+	"env.ip":                 true,
+	"env.time":               true,
+	"env.weekday":            true,
+}
+
+func validAttribute(name string) bool {
+	for _, prefix := range []string{"subject.attributes.", "resource.attributes."} {
+		if strings.HasPrefix(name, prefix) {
+			return len(name) > len(prefix)
+		}
+	}
+	return policyAttributes[name]
+}
+
+// policyInput is what policy rules are evaluated against.
+type policyInput struct {
+	user     UserData
+	roles    []string
+	level    Role
+	action   string
+	resource Resource
+	env      Environment
+}
+
+// attribute returns the values of the named attribute.
+func (in policyInput) attribute(name string) []string {
+	switch name {
+	case "action":
+		return values(in.action)
+	case "subject.username":
+		return values(in.user.Username)
+	case "subject.email":
+		return values(in.user.Email)
+	case "subject.email_verified":
+		return values(strconv.FormatBool(in.user.EmailVerified))
+	case "subject.role":
+		return values(in.user.Role)
+	case "subject.roles":
+		return in.roles
+	case "subject.groups":
+		return in.user.Groups
+	case "subject.level":
+		return values(strconv.Itoa(int(in.level)))
+	case "resource.type":
+		return values(in.resource.Type)
+	case "resource.id":
+		return values(in.resource.ID)
+	case "resource.owner":
+		return values(in.resource.Owner)
+	case "env.ip":
+		return values(in.env.IP)
+	case "env.time":
+		return values(in.env.Time.Format(time.RFC3339))
+	case "env.weekday":
+		return values(in.env.Time.Weekday().String())
+	}
+	if key := strings.TrimPrefix(name, "subject.attributes."); key != name {
+		return values(in.user.Attributes[key])
+	}
+	if key := strings.TrimPrefix(name, "resource.attributes."); key != name {
+		return values(in.resource.Attributes[key])
+	}
+	return nil
+}
+
+// values returns s as the only value of an attribute, or no values if it is
+// empty.
+func values(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// matches reports whether the rule is about action on resources of the given
+// type.
+func (r *compiledRule) matches(action string, resourceType string) bool {
+	return matchAny(r.Actions, action) && (len(r.Resources) == 0 || matchAny(r.Resources, resourceType))
+}
+
+// unmet returns why the rule doesn't apply to in, or "" if it does.
+func (r *compiledRule) unmet(roles *roleSet, in policyInput) string {
+	if r.Role != "" {
+		level, ok := roles.level(r.Role)
+		if !ok {
+			return fmt.Sprintf("needs unknown role %q", r.Role)
+		}
+		if in.level < level {
+			return fmt.Sprintf("needs role %q", r.Role)
+		}
+	}
+	for _, c := range r.conditions {
+		if !c.holds(in) {
+			return fmt.Sprintf("needs %s", c)
+		}
+	}
+	return ""
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// operands returns what the attribute is compared with.
+func (c compiledCondition) operands(in policyInput) []string {
+	if c.Ref != "" {
+		return in.attribute(c.Ref)
+	}
+	if len(c.Values) > 0 {
+		return c.Values
+	}
+	return []string{c.Value}
+}
+
+// holds reports whether the condition is true for in.
+func (c compiledCondition) holds(in policyInput) bool {
+	vals := in.attribute(c.Attribute)
+	switch c.Op {
+	case "eq", "in":
+		return intersects(vals, c.operands(in))
+	case "ne", "not_in":
+		return !intersects(vals, c.operands(in))
+	case "exists":
+		return len(vals) > 0
+	case "gt", "gte", "lt", "lte":
+		for _, v := range vals {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			for _, o := range c.operands(in) {
+				y, err := strconv.ParseFloat(o, 64)
+				if err == nil && compareNumbers(c.Op, x, y) {
+					return true
+				}
+			}
+		}
+	case "cidr":
+		for _, v := range vals {
+			ip := net.ParseIP(v)
+			for _, network := range c.networks {
+				if ip != nil && network.Contains(ip) {
+					return true
+				}
+			}
+		}
+	case "between":
+		for _, v := range vals {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				continue
+			}
+			m := t.Hour()*60 + t.Minute()
+			if c.from <= c.to && m >= c.from && m < c.to || c.from > c.to && (m >= c.from || m < c.to) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c compiledCondition) String() string {
+	operand := c.Value
+	switch {
+	case c.Ref != "":
+		operand = c.Ref
+	case len(c.Values) > 0:
+		operand = "[" + strings.Join(c.Values, " ") + "]"
+	}
+	if c.Op == "exists" {
+		return c.Attribute + " to exist"
+	}
+	return c.Attribute + " " + c.Op + " " + operand
+}
+
+func intersects(a []string, b []string) bool {
+	for _, s := range a {
+		if containsString(b, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareNumbers(op string, x float64, y float64) bool {
+	switch op {
+	case "gt":
+		return x > y
+	case "gte":
+		return x >= y
+	case "lt":
+		return x < y
+	}
+	return x <= y
+}
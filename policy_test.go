@@ -0,0 +1,193 @@
+package httpauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+rules:
+  - name: read-published
+    effect: allow
+    actions: ["posts:read"]
+    resources: [post]
+    conditions:
+      - {attribute: resource.attributes.status, op: eq, value: published}
+  - name: edit-own-at-office
+    effect: allow
+    actions: ["posts:*"]
+    resources: [post]
+    role: user
+    conditions:
+      - {attribute: resource.owner, op: eq, ref: subject.username}
+      - {attribute: env.ip, op: cidr, values: ["10.0.0.0/8"]}
+      - {attribute: env.time, op: between, values: ["08:00", "18:00"]}
+  - name: admins
+    effect: allow
+    actions: ["*"]
+    role: admin
+  - name: no-sales-deletes
+    effect: deny
+    actions: ["posts:delete"]
+    conditions:
+      - {attribute: subject.attributes.department, op: in, values: [sales, marketing]}
+`
+
+// policyContext returns a context for Can, with the user stored by the
+// Authorizer and the given environment.
+func policyContext(t *testing.T, auth Authorizer, username string, env Environment) context.Context {
+	ctx := context.Background()
+	if username != "" {
+		user, err := auth.backend.User(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx = context.WithValue(ctx, userContextKey, user)
+	}
+	return ContextWithEnvironment(ctx, env)
+}
+
+func TestCan(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	if d := auth.Can(context.Background(), "posts:read", Resource{Type: "post"}); d.Allowed {
+		t.Fatalf("Can: allowed without a policy: %v", d)
+	}
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+	if err := auth.SetPolicy(p); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	auth.SetUserAttributes("user", map[string]string{"department": "sales"})
+
+	office := Environment{IP: "10.1.2.3", Time: time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)}
+	home := Environment{IP: "192.168.1.2", Time: office.Time}
+	night := Environment{IP: office.IP, Time: time.Date(2024, 5, 6, 22, 0, 0, 0, time.UTC)}
+	own := Resource{Type: "post", ID: "1", Owner: "user"}
+	other := Resource{Type: "post", ID: "2", Owner: "admin"}
+	published := Resource{Type: "post", ID: "3", Attributes: map[string]string{"status": "published"}}
+
+	for _, c := range []struct {
+		user     string
+		env      Environment
+		action   string
+		resource Resource
+		allowed  bool
+		rule     string
+	}{
+		{"", office, "posts:read", published, true, "read-published"},
+		{"", office, "posts:read", own, false, ""},
+		{"user", office, "posts:edit", own, true, "edit-own-at-office"},
+		{"user", office, "posts:edit", other, false, ""},
+		{"user", home, "posts:edit", own, false, ""},
+		{"user", night, "posts:edit", own, false, ""},
+		{"user", office, "posts:delete", own, false, "no-sales-deletes"},
+		{"admin", home, "posts:delete", other, true, "admins"},
+		{"admin", home, "users:ban", Resource{Type: "user", ID: "user"}, true, "admins"},
+	} {
+		d := auth.Can(policyContext(t, auth, c.user, c.env), c.action, c.resource)
+		if d.Allowed != c.allowed || d.Rule != c.rule {
+			t.Errorf("Can(%q, %v, %v): expected %v by %q, got %+v", c.user, c.action, c.resource, c.allowed, c.rule, d)
+		}
+	}
+
+	d := auth.Can(policyContext(t, auth, "user", home), "posts:edit", own)
+	if !strings.Contains(d.Reason, `"edit-own-at-office" needs env.ip cidr [10.0.0.0/8]`) {
+		t.Errorf("Can: explanation doesn't name the failed condition: %q", d.Reason)
+	}
+	d = auth.Can(policyContext(t, auth, "user", office), "posts:delete", own)
+	if d.Reason != `rule "no-sales-deletes" denies posts:delete on post/1` {
+		t.Errorf("Can: wrong explanation %q", d.Reason)
+	}
+
+	// Roles held through groups count.
+	auth.AddGroup("admins", "admin")
+	auth.SetUserGroups(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "admins")
+	if d := auth.Can(policyContext(t, auth, "user", home), "users:ban", Resource{Type: "user"}); !d.Allowed {
+		t.Errorf("Can: group role not applied: %v", d)
+	}
+}
+
+func TestCanInHandler(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	if err := auth.SetPolicy(&Policy{Rules: []PolicyRule{{
+		Name:       "localhost",
+		Effect:     PolicyAllow,
+		Actions:    []string{"reports:view"},
+		Conditions: []PolicyCondition{{Attribute: "env.ip", Op: "eq", Value: "127.0.0.1"}},
+	}}}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	var d Decision
+	h := auth.RequireLogin(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		d = auth.Can(req.Context(), "reports:view", Resource{Type: "report"})
+	}))
+	req := newTestRequest("GET", loginCookies(t, auth, "user"))
+	req.RemoteAddr = "127.0.0.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !d.Allowed {
+		t.Fatalf("Can: expected environment from the request, got %v", d)
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	for name, policy := range map[string]string{
+		"unknown field":     `rules: [{name: a, effect: allow, actions: [x], colour: red}]`,
+		"no name":           `rules: [{effect: allow, actions: [x]}]`,
+		"bad effect":        `rules: [{name: a, effect: maybe, actions: [x]}]`,
+		"no actions":        `rules: [{name: a, effect: allow}]`,
+		"bad pattern":       `rules: [{name: a, effect: allow, actions: ["["]}]`,
+		"unknown attribute": `rules: [{name: a, effect: allow, actions: [x], conditions: [{attribute: subject.age, op: eq, value: "1"}]}]`,
+		"unknown op":        `rules: [{name: a, effect: allow, actions: [x], conditions: [{attribute: env.ip, op: like, value: "1"}]}]`,
+		"bad network":       `rules: [{name: a, effect: allow, actions: [x], conditions: [{attribute: env.ip, op: cidr, values: [10.0.0.0]}]}]`,
+		"bad time":          `rules: [{name: a, effect: allow, actions: [x], conditions: [{attribute: env.time, op: between, values: ["9am", "5pm"]}]}]`,
+		"bad number":        `rules: [{name: a, effect: allow, actions: [x], conditions: [{attribute: subject.level, op: gte, value: high}]}]`,
+		"json":              `{"rules": [{"name": "a", "effect": "allow", "actions": ["x"], "role": 1}]}`,
+	} {
+		p, err := ParsePolicy([]byte(policy))
+		if err == nil {
+			auth := newTestAuthorizer(t)
+			err = auth.SetPolicy(p)
+		}
+		if !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("%v: expected ErrInvalidPolicy, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"policy.yaml": testPolicy,
+		"policy.json": `{"rules": [{"name": "levels", "effect": "allow", "actions": ["*"],
+			"conditions": [{"attribute": "subject.level", "op": "gte", "value": "80"}]}]}`,
+	} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		p, err := LoadPolicyFile(filename)
+		if err != nil {
+			t.Fatalf("LoadPolicyFile(%v): %v", name, err)
+		}
+		auth, err := NewAuthorizerWithOptions(newTestAuthorizer(t).backend,
+			WithKey([]byte("testkey")), WithRoles("user", map[string]Role{"user": 40, "admin": 80}), WithPolicy(p))
+		if err != nil {
+			t.Fatalf("NewAuthorizerWithOptions(%v): %v", name, err)
+		}
+		if d := auth.Can(policyContext(t, auth, "admin", Environment{}), "users:ban", Resource{Type: "user"}); !d.Allowed {
+			t.Errorf("Can with %v: %v", name, d)
+		}
+	}
+	if _, err := LoadPolicyFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Fatal("LoadPolicyFile: no error for missing file")
+	}
+}
@@ -0,0 +1,74 @@
+package httpauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Number of recovery codes generated at a time.
+const recoveryCodeCount = 10
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes creates a new set of single use recovery codes for the
+// logged in user, replacing any previous set. Each one can be given to
+// VerifySecondFactor instead of a TOTP code once. Only hashes of the codes are
+// stored, so they have to be shown to the user now.
+//
+// Returns ErrTOTPNotEnrolled if the user hasn't enabled two factor
+// authentication.
+func (a Authorizer) GenerateRecoveryCodes(rw http.ResponseWriter, req *http.Request) ([]string, error) {
+	user, err := a.currentUserForUpdate(rw, req)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnrolled
+	}
+	codes := make([]string, recoveryCodeCount)
+	user.RecoveryCodes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := randomBytes(5)
+		if err != nil {
+			return nil, err
+		}
+		code := recoveryEncoding.EncodeToString(b)
+		codes[i] = code[:4] + "-" + code[4:]
+		user.RecoveryCodes[i] = hashRecoveryCode(code)
+	}
+	if err := a.saveCurrentUser(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the stored form of a recovery code. Codes are
+// random enough that a fast hash is sufficient.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode removes code from user's recovery codes, reporting whether
+// it was there.
+func useRecoveryCode(user *UserData, code string) bool {
+	hash := hashRecoveryCode(code)
+	found := -1
+	for i, h := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return false
+	}
+	codes := make([]string, 0, len(user.RecoveryCodes)-1)
+	codes = append(codes, user.RecoveryCodes[:found]...)
+	user.RecoveryCodes = append(codes, user.RecoveryCodes[found+1:]...)
+	return true
+}
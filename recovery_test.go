@@ -0,0 +1,91 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pendingLogin logs a user with two factor authentication in, returning the
+// cookies of the half authenticated session.
+func pendingLogin(t *testing.T, auth Authorizer, username string) []*http.Cookie {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, username, "password", ""); !errors.Is(err, ErrSecondFactorRequired) {
+		t.Fatalf("Login: expected ErrSecondFactorRequired, got %v", err)
+	}
+	return rw.Result().Cookies()
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	cookies := loginCookies(t, auth, "user")
+	if _, err := auth.GenerateRecoveryCodes(httptest.NewRecorder(), newTestRequest("POST", cookies)); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Fatalf("GenerateRecoveryCodes: expected ErrTOTPNotEnrolled, got %v", err)
+	}
+
+	_, cookies = enableTOTP(t, auth, "user")
+	codes, err := auth.GenerateRecoveryCodes(httptest.NewRecorder(), newTestRequest("POST", cookies))
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("GenerateRecoveryCodes: expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+	user, _ := auth.backend.User("user")
+	for _, h := range user.RecoveryCodes {
+		for _, c := range codes {
+			if h == c {
+				t.Fatal("Recovery code stored in plain text")
+			}
+		}
+	}
+
+	if err := auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pendingLogin(t, auth, "user")), codes[3], ""); err != nil {
+		t.Fatalf("VerifySecondFactor with recovery code: %v", err)
+	}
+	user, _ = auth.backend.User("user")
+	if len(user.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Fatal("Recovery code not consumed")
+	}
+	err = auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pendingLogin(t, auth, "user")), codes[3], "")
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("VerifySecondFactor: expected ErrInvalidCode for used code, got %v", err)
+	}
+
+	// Regenerating replaces the old set.
+	newCodes, err := auth.GenerateRecoveryCodes(httptest.NewRecorder(), newTestRequest("POST", cookies))
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	err = auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pendingLogin(t, auth, "user")), codes[0], "")
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("VerifySecondFactor: expected ErrInvalidCode for replaced code, got %v", err)
+	}
+	if err := auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pendingLogin(t, auth, "user")), newCodes[0], ""); err != nil {
+		t.Fatalf("VerifySecondFactor with new recovery code: %v", err)
+	}
+}
+
+func TestDisableTOTPWithRecoveryCode(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	_, cookies := enableTOTP(t, auth, "user")
+	codes, err := auth.GenerateRecoveryCodes(httptest.NewRecorder(), newTestRequest("POST", cookies))
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	if err := auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pendingLogin(t, auth, "user")), codes[0], ""); err != nil {
+		t.Fatalf("VerifySecondFactor with recovery code: %v", err)
+	}
+	err = auth.DisableTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), codes[0])
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("DisableTOTP: expected ErrInvalidCode for used code, got %v", err)
+	}
+	if err := auth.DisableTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), codes[1]); err != nil {
+		t.Fatalf("DisableTOTP with recovery code: %v", err)
+	}
+	if _, _, err := auth.EnrollTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), "Example"); err != nil {
+		t.Fatalf("EnrollTOTP after disabling: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package httpauth
+
+import (
+	"net/url"
+	"strings"
+)
+
+// SetRedirectHosts sets the hosts Login may redirect to with an absolute URL,
+// such as "app.example.com" or "app.example.com:8443". Without any, only
+// paths on the same site are followed; see Login.
+func (a *Authorizer) SetRedirectHosts(hosts ...string) {
+	a.redirectHosts = hosts
+}
+
+// safeRedirect reports whether target can be redirected to after logging in:
+// either a path on the same site, or an http(s) URL on an allowed host.
+func (a Authorizer) safeRedirect(target string) bool {
+	if target == "" || strings.ContainsAny(target, "\\\x00\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" && u.User == nil {
+		// "//host/path" is an absolute URL to browsers.
+		return !strings.HasPrefix(target, "//")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, host := range a.redirectHosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectTarget returns where to send a user who logged in: the page saved
+// by an authorization redirect if there is one, or else dest. Unsafe targets
+// are replaced by dest, or by "/" if dest itself is unsafe.
+func (a Authorizer) redirectTarget(saved string, dest string) string {
+	if saved != "" {
+		if a.safeRedirect(saved) {
+			return saved
+		}
+		a.logf("refused redirect to %q", saved)
+	}
+	if !a.safeRedirect(dest) {
+		a.logf("refused redirect to %q", dest)
+		return "/"
+	}
+	return dest
+}
@@ -0,0 +1,90 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSafeRedirect(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetRedirectHosts("app.example.com", "admin.example.com:8443")
+	for target, safe := range map[string]bool{
+		"/":                                        true,
+		"/private?tab=2#top":                       true,
+		"settings":                                 true,
+		"":                                         false,
+		"//evil.com/":                              false,
+		"/\\evil.com":                              false,
+		"https://evil.com/":                        false,
+		"https://app.example.com.evil.com/":        false,
+		"javascript:alert(1)":                      false,
+		"https://user@evil.com":                    false,
+		"/\r\nSet-Cookie: x=y":                     false,
+		"https://app.example.com/home":             true,
+		"http://APP.example.com:8080/":             true,
+		"https://admin.example.com:8443/":          true,
+		"https://admin.example.com/":               false,
+		"ftp://app.example.com/":                   false,
+		"https://app.example.com@evil.com/":        false,
+		"https:app.example.com":                    false,
+		"https://evil.com/app.example.com":         false,
+		"/redirect?to=https://evil.com":            true,
+		"https://evil.com?app.example.com":         false,
+		"https://evil.com#https://app.example.com": false,
+	} {
+		if got := auth.safeRedirect(target); got != safe {
+			t.Errorf("safeRedirect(%q) = %v, want %v", target, got, safe)
+		}
+	}
+}
+
+// loginRedirect logs user in with the given cookies and dest and returns the
+// redirect location.
+func loginRedirect(t *testing.T, auth Authorizer, cookies []*http.Cookie, dest string) string {
+	rw := httptest.NewRecorder()
+	if err := auth.Login(rw, newTestRequest("POST", cookies), "user", "password", dest); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return rw.Header().Get("Location")
+}
+
+func TestLoginRedirect(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetRedirectHosts("app.example.com")
+
+	// The page that required a login is saved with its query string.
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/private?tab=2", nil)
+	req.Header.Set("Accept", "text/html")
+	auth.RequireLogin(http.NotFoundHandler()).ServeHTTP(rw, req)
+	if loc := loginRedirect(t, auth, rw.Result().Cookies(), "/home"); loc != "/private?tab=2" {
+		t.Fatalf("Login: expected redirect to /private?tab=2, got %q", loc)
+	}
+
+	saved := func(target string) []*http.Cookie {
+		rw := httptest.NewRecorder()
+		req := newTestRequest("GET", nil)
+		session, _ := auth.redirectSession(req)
+		session.AddFlash(target)
+		session.Save(req, rw)
+		return rw.Result().Cookies()
+	}
+	for _, c := range []struct {
+		saved, dest, want string
+	}{
+		{"https://evil.com/", "/home", "/home"},
+		{"//evil.com/", "/home", "/home"},
+		{"", "https://evil.com/", "/"},
+		{"", "https://app.example.com/home", "https://app.example.com/home"},
+		{"https://app.example.com/private", "/home", "https://app.example.com/private"},
+	} {
+		var cookies []*http.Cookie
+		if c.saved != "" {
+			cookies = saved(c.saved)
+		}
+		if loc := loginRedirect(t, auth, cookies, c.dest); loc != c.want {
+			t.Errorf("Login(saved %q, dest %q): expected redirect to %q, got %q", c.saved, c.dest, c.want, loc)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package httpauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// RequestPasswordReset emails a password reset link to every user with the
+// given email address. To avoid revealing which addresses have accounts, the
+// emails are sent in the background, and errors sending them are only logged.
+func (a Authorizer) RequestPasswordReset(email string) error {
+	if a.email.Mailer == nil {
+		return ErrNoMailer
+	}
+	a.mailUsers(email, "password reset email", func(user UserData) error {
+		t, err := a.signToken(tokenResetPassword, user.Username, hashFingerprint(user.Hash), a.email.ResetTTL)
+		if err != nil {
+			return err
+		}
+		link, err := emailLink(a.email.ResetURL, t)
+		if err != nil {
+			return err
+		}
+		return a.email.Mailer.Send(Mail{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: "Someone asked to reset the password for " + user.Username + ". If it was you, visit this link to choose a new one:\n\n" +
+				link + "\n\nOtherwise you can ignore this email.\n",
+		})
+	})
+	return nil
+}
+
+// ResetPassword sets a new password for the user a reset link was sent to.
+// Each link works once: it is tied to the old password hash, so it stops
+// working as soon as the password changes. Since the link proves the user
+// reads mail sent to their address, it is marked as verified. All of the
+// user's sessions are ended.
+//
+// ErrInvalidToken is returned for bad or used links, including ones for
+// users that no longer exist.
+func (a Authorizer) ResetPassword(token string, password string) error {
+	t, err := a.parseToken(tokenResetPassword, token)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("%w: no password given", ErrInvalidUser)
+	}
+	user, err := a.backend.User(t.Username)
+	if err == ErrMissingUser {
+		return ErrInvalidToken
+	} else if err != nil {
+		return backendError(err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashFingerprint(user.Hash)), []byte(t.Check)) != 1 {
+		return ErrInvalidToken
+	}
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("httpauth: couldn't save password: %w", err)
+	}
+	user.Hash = hash
+	user.EmailVerified = true
+	user.SessionGeneration++
+	if err := a.backend.SaveUser(user); err != nil {
+		return backendError(err)
+	}
+	a.rotateSessions(nil, nil, user)
+	a.resetFailures(user.Username)
+	a.emit(nil, Event{Type: EventPasswordReset, Username: user.Username})
+	return nil
+}
+
+// hashFingerprint identifies a password hash without revealing it.
+func hashFingerprint(hash []byte) string {
+	sum := sha256.Sum256(hash)
+	return hex.EncodeToString(sum[:16])
+}
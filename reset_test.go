@@ -0,0 +1,76 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, ResetURL: "https://example.com/reset"})
+
+	if err := auth.RequestPasswordReset("nobody@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset: unknown address revealed: %v", err)
+	}
+	if err := auth.RequestPasswordReset("user@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset: %v", err)
+	}
+	if sent := waitForMail(t, mailer, 1); len(sent) != 1 || sent[0].To != "user@example.com" {
+		t.Fatalf("RequestPasswordReset: expected one email to user@example.com, got %+v", sent)
+	}
+	token := mailToken(t, mailer, "user@example.com")
+	cookies := loginCookies(t, auth, "user")
+
+	if err := auth.ResetPassword(token, "newpassword"); err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); err == nil {
+		t.Fatal("Authorize: session survived ResetPassword")
+	}
+	if err := lockoutLogin(auth, "10.0.0.1", "user", "password"); !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("Login: old password still works: %v", err)
+	}
+	if err := lockoutLogin(auth, "10.0.0.1", "user", "newpassword"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := auth.ResetPassword(token, "otherpassword"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("ResetPassword: expected ErrInvalidToken for used token, got %v", err)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	mailer := &MemoryMailer{}
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, ResetURL: "/reset", ResetTTL: -time.Minute})
+	auth.RequestPasswordReset("user@example.com")
+	waitForMail(t, mailer, 1)
+	token := mailToken(t, mailer, "user@example.com")
+	if err := auth.ResetPassword(token, "newpassword"); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("ResetPassword: expected ErrTokenExpired, got %v", err)
+	}
+
+	// Tokens for other purposes aren't accepted.
+	auth.SetEmailConfig(EmailConfig{Mailer: mailer, VerifyURL: "/verify"})
+	auth.SendVerificationEmail("user")
+	if err := auth.ResetPassword(mailToken(t, mailer, "user@example.com"), "newpassword"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("ResetPassword: expected ErrInvalidToken for verification token, got %v", err)
+	}
+}
+
+// failingMailer is a Mailer that can't send anything.
+type failingMailer struct{}
+
+func (failingMailer) Send(m Mail) error {
+	return errors.New("connection refused")
+}
+
+func TestPasswordResetSendError(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetEmailConfig(EmailConfig{Mailer: failingMailer{}, ResetURL: "/reset"})
+	if err := auth.RequestPasswordReset("user@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset: send error revealed: %v", err)
+	}
+}
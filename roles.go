@@ -0,0 +1,417 @@
+package httpauth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrRoleExists is returned when adding or renaming to a role name that is
+// taken.
+// ErrInvalidRole is returned for empty role names, names containing commas and
+// levels below one.
+// ErrRoleInUse matches the *RoleInUseError returned by DeleteRole.
+// ErrNoRoleBackend is returned by ReloadRoles if the AuthBackend doesn't store
+// roles.
+var (
+	ErrRoleExists    = mkerror("role already exists")
+	ErrInvalidRole   = mkerror("invalid role")
+	ErrRoleInUse     = mkerror("role in use")
+	ErrNoRoleBackend = mkerror("backend doesn't store roles")
+)
+
+// RoleInUseError is returned by DeleteRole for a role that users hold, that
+// other roles inherit, that groups grant, or that new users get. It matches
+// ErrRoleInUse.
+type RoleInUseError struct {
+	Role    string
+	Users   []string // usernames of the users holding the role, sorted
+	Roles   []string // names of the roles inheriting it, sorted
+	Groups  []string // names of the groups granting it, sorted
+	Default bool     // whether it is the default role
+}
+
+func (e *RoleInUseError) Error() string {
+	switch {
+	case e.Default:
+		return fmt.Sprintf("httpauth: role %q is the default role", e.Role)
+	case len(e.Users) > 0:
+		return fmt.Sprintf("httpauth: role %q is held by %d users", e.Role, len(e.Users))
+	case len(e.Roles) > 0:
+		return fmt.Sprintf("httpauth: role %q is inherited by %d roles", e.Role, len(e.Roles))
+	}
+	return fmt.Sprintf("httpauth: role %q is granted by %d groups", e.Role, len(e.Groups))
+}
+
+// Is reports whether target is ErrRoleInUse.
+func (e *RoleInUseError) Is(target error) bool {
+	return target == ErrRoleInUse
+}
+
+// RoleDefinition is a role as stored by a RoleBackend. Besides its Level, a
+// role grants Permissions, and all permissions of the roles it Inherits; see
+// AuthorizePermission.
+type RoleDefinition struct {
+	Name        string
+	Level       Role
+	Permissions []string
+	Inherits    []string
+}
+
+// RoleBackend is implemented by AuthBackends that store role definitions, so
+// that roles changed with AddRole and friends persist and are shared by every
+// Authorizer using the backend. The gob file, SQL and leveldb backends
+// implement it.
+type RoleBackend interface {
+	Roles() ([]RoleDefinition, error)
+	// SaveRole adds a role, or replaces the one with the same name.
+	SaveRole(r RoleDefinition) error
+	DeleteRole(name string) error
+}
+
+// roleSet holds the roles of an Authorizer. It is shared by copies of the
+// Authorizer, so changes made through any of them apply to all.
+type roleSet struct {
+	mu          sync.RWMutex
+	defs        map[string]RoleDefinition
+	groups      map[string]GroupDefinition
+	defaultRole string
+}
+
+// level returns the level of the named role.
+func (s *roleSet) level(name string) (Role, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.defs[name]
+	return r.Level, ok
+}
+
+// maxLevel returns the highest level of the named roles, or zero if none of
+// them is known.
+func (s *roleSet) maxLevel(roles []string) Role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var max Role
+	for _, name := range roles {
+		if r, ok := s.defs[name]; ok && r.Level > max {
+			max = r.Level
+		}
+	}
+	return max
+}
+
+// defaultName returns the name of the role new users get.
+func (s *roleSet) defaultName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.defaultRole
+}
+
+// loadRoles sets up the roles and groups of a new Authorizer. If the backend
+// is a RoleBackend, roles it stores take precedence over the given ones, and
+// given ones it doesn't have yet are added to it.
+func (a *Authorizer) loadRoles(defaultRole string, roles []RoleDefinition) error {
+	defs := make(map[string]RoleDefinition, len(roles))
+	for _, r := range roles {
+		defs[r.Name] = r
+	}
+	groups, err := a.storedGroups()
+	if err != nil {
+		return err
+	}
+	if groups == nil {
+		groups = make(map[string]GroupDefinition)
+	}
+	a.roles = &roleSet{defs: defs, groups: groups, defaultRole: defaultRole}
+	rb, ok := a.backend.(RoleBackend)
+	if !ok {
+		return nil
+	}
+	stored, err := rb.Roles()
+	if err != nil {
+		return backendError(err)
+	}
+	have := make(map[string]bool, len(stored))
+	for _, r := range stored {
+		have[r.Name] = true
+		defs[r.Name] = r
+	}
+	for _, r := range roles {
+		if have[r.Name] {
+			continue
+		}
+		if err := rb.SaveRole(r); err != nil {
+			return backendError(err)
+		}
+	}
+	return nil
+}
+
+// Roles returns the current roles and their levels.
+func (a Authorizer) Roles() map[string]Role {
+	a.roles.mu.RLock()
+	defer a.roles.mu.RUnlock()
+	roles := make(map[string]Role, len(a.roles.defs))
+	for name, r := range a.roles.defs {
+		roles[name] = r.Level
+	}
+	return roles
+}
+
+// RoleDefinitions returns the current roles, sorted by name.
+func (a Authorizer) RoleDefinitions() []RoleDefinition {
+	a.roles.mu.RLock()
+	defer a.roles.mu.RUnlock()
+	defs := make([]RoleDefinition, 0, len(a.roles.defs))
+	for _, r := range a.roles.defs {
+		defs = append(defs, r)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// ReloadRoles replaces the roles, and the groups if the backend is a
+// GroupBackend, with the ones stored by the backend, to pick up changes made
+// by other Authorizers. It returns ErrNoRoleBackend if the backend doesn't
+// implement RoleBackend, and ErrRoleNotFound if the default role is gone.
+func (a Authorizer) ReloadRoles() error {
+	rb, ok := a.backend.(RoleBackend)
+	if !ok {
+		return ErrNoRoleBackend
+	}
+	stored, err := rb.Roles()
+	if err != nil {
+		return backendError(err)
+	}
+	defs := make(map[string]RoleDefinition, len(stored))
+	for _, r := range stored {
+		defs[r.Name] = r
+	}
+	groups, err := a.storedGroups()
+	if err != nil {
+		return err
+	}
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	if _, ok := defs[a.roles.defaultRole]; !ok {
+		return fmt.Errorf("%w: default role %q", ErrRoleNotFound, a.roles.defaultRole)
+	}
+	a.roles.defs = defs
+	if groups != nil {
+		a.roles.groups = groups
+	}
+	return nil
+}
+
+// AddRole adds a role with the given level, which must be at least one.
+func (a Authorizer) AddRole(name string, level Role) error {
+	if err := validRole(name, level); err != nil {
+		return err
+	}
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	if _, ok := a.roles.defs[name]; ok {
+		return fmt.Errorf("%w: %q", ErrRoleExists, name)
+	}
+	return a.saveRole(RoleDefinition{Name: name, Level: level})
+}
+
+// UpdateRoleLevel changes the level of a role, which must be at least one.
+func (a Authorizer) UpdateRoleLevel(name string, level Role) error {
+	if err := validRole(name, level); err != nil {
+		return err
+	}
+	return a.updateRole(name, func(r *RoleDefinition) error {
+		r.Level = level
+		return nil
+	})
+}
+
+// RenameRole renames a role, moving the users holding it, the roles
+// inheriting it and the groups granting it to the new name. If it was the
+// default role, the new name becomes the default. Session timeouts set for
+// the old name (see SetSessionTimeouts) aren't moved.
+//
+// Rename the role in the map passed to NewAuthorizer as well; otherwise the
+// old name is added back to a RoleBackend when the next Authorizer starts.
+func (a Authorizer) RenameRole(oldName string, newName string) error {
+	if err := validRoleName(newName); err != nil {
+		return err
+	}
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	r, ok := a.roles.defs[oldName]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrRoleNotFound, oldName)
+	}
+	if _, ok := a.roles.defs[newName]; ok {
+		return fmt.Errorf("%w: %q", ErrRoleExists, newName)
+	}
+	// Both names stay valid until everything has moved, so that a failure
+	// part way leaves no user or role referring to an unknown role.
+	r.Name = newName
+	if err := a.saveRole(r); err != nil {
+		return err
+	}
+	for _, other := range a.roles.defs {
+		if !containsString(other.Inherits, oldName) {
+			continue
+		}
+		other.Inherits = replaceString(other.Inherits, oldName, newName)
+		if err := a.saveRole(other); err != nil {
+			return err
+		}
+	}
+	for _, g := range a.roles.groups {
+		if !containsString(g.Roles, oldName) {
+			continue
+		}
+		g.Roles = replaceString(g.Roles, oldName, newName)
+		if err := a.saveGroup(g); err != nil {
+			return err
+		}
+	}
+	users, err := a.backend.Users()
+	if err != nil {
+		return backendError(err)
+	}
+	for _, user := range users {
+		if user.Role != oldName && !containsString(user.Roles, oldName) {
+			continue
+		}
+		if user.Role == oldName {
+			user.Role = newName
+		}
+		user.Roles = replaceString(user.Roles, oldName, newName)
+		if err := a.backend.SaveUser(user); err != nil {
+			return backendError(err)
+		}
+	}
+	if rb, ok := a.backend.(RoleBackend); ok {
+		if err := rb.DeleteRole(oldName); err != nil {
+			return backendError(err)
+		}
+	}
+	delete(a.roles.defs, oldName)
+	if a.roles.defaultRole == oldName {
+		a.roles.defaultRole = newName
+	}
+	return nil
+}
+
+// DeleteRole removes a role. It returns a *RoleInUseError while users still
+// hold the role, while other roles inherit it or groups grant it, or if it is
+// the default role.
+func (a Authorizer) DeleteRole(name string) error {
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	if _, ok := a.roles.defs[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrRoleNotFound, name)
+	}
+	if name == a.roles.defaultRole {
+		return &RoleInUseError{Role: name, Default: true}
+	}
+	users, err := a.backend.Users()
+	if err != nil {
+		return backendError(err)
+	}
+	inUse := &RoleInUseError{Role: name}
+	for _, user := range users {
+		if user.Role == name || containsString(user.Roles, name) {
+			inUse.Users = append(inUse.Users, user.Username)
+		}
+	}
+	for _, other := range a.roles.defs {
+		if containsString(other.Inherits, name) {
+			inUse.Roles = append(inUse.Roles, other.Name)
+		}
+	}
+	for _, g := range a.roles.groups {
+		if containsString(g.Roles, name) {
+			inUse.Groups = append(inUse.Groups, g.Name)
+		}
+	}
+	if len(inUse.Users) > 0 || len(inUse.Roles) > 0 || len(inUse.Groups) > 0 {
+		sort.Strings(inUse.Users)
+		sort.Strings(inUse.Roles)
+		sort.Strings(inUse.Groups)
+		return inUse
+	}
+	if rb, ok := a.backend.(RoleBackend); ok {
+		if err := rb.DeleteRole(name); err != nil {
+			return backendError(err)
+		}
+	}
+	delete(a.roles.defs, name)
+	return nil
+}
+
+// updateRole changes the named role with change, and saves it.
+func (a Authorizer) updateRole(name string, change func(r *RoleDefinition) error) error {
+	a.roles.mu.Lock()
+	defer a.roles.mu.Unlock()
+	r, ok := a.roles.defs[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrRoleNotFound, name)
+	}
+	if err := change(&r); err != nil {
+		return err
+	}
+	return a.saveRole(r)
+}
+
+// saveRole stores r, in the backend if it is a RoleBackend. The caller holds
+// the lock.
+func (a Authorizer) saveRole(r RoleDefinition) error {
+	if rb, ok := a.backend.(RoleBackend); ok {
+		if err := rb.SaveRole(r); err != nil {
+			return backendError(err)
+		}
+	}
+	a.roles.defs[r.Name] = r
+	return nil
+}
+
+func validRole(name string, level Role) error {
+	if err := validRoleName(name); err != nil {
+		return err
+	}
+	if level < 1 {
+		return fmt.Errorf("%w: level of %q must be at least 1", ErrInvalidRole, name)
+	}
+	return nil
+}
+
+// validRoleName rejects names that can't be stored, since backends keep lists
+// of roles separated by commas.
+func validRoleName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: no name given", ErrInvalidRole)
+	}
+	if strings.Contains(name, ",") {
+		return fmt.Errorf("%w: %q contains a comma", ErrInvalidRole, name)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceString returns a copy of list with old replaced by new.
+func replaceString(list []string, old string, new string) []string {
+	replaced := make([]string, len(list))
+	for i, item := range list {
+		if item == old {
+			item = new
+		}
+		replaced[i] = item
+	}
+	return replaced
+}
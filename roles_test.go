@@ -0,0 +1,119 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRoleManagement(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	copied := auth
+
+	if err := auth.AddRole("moderator", 60); err != nil {
+		t.Fatalf("AddRole: %v", err)
+	}
+	if err := auth.AddRole("moderator", 60); !errors.Is(err, ErrRoleExists) {
+		t.Fatalf("AddRole: expected ErrRoleExists, got %v", err)
+	}
+	if err := auth.AddRole("guest", 0); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("AddRole: expected ErrInvalidRole, got %v", err)
+	}
+	if err := auth.AddRole("a,b", 10); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("AddRole: expected ErrInvalidRole for comma, got %v", err)
+	}
+	if err := auth.UpdateRoleLevel("moderator", 90); err != nil {
+		t.Fatalf("UpdateRoleLevel: %v", err)
+	}
+	if err := auth.UpdateRoleLevel("nobody", 10); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("UpdateRoleLevel: expected ErrRoleNotFound, got %v", err)
+	}
+	want := map[string]Role{"user": 40, "admin": 80, "moderator": 90}
+	if roles := auth.Roles(); !reflect.DeepEqual(roles, want) {
+		t.Fatalf("Roles: expected %v, got %v", want, roles)
+	}
+
+	// Copies of the Authorizer share roles.
+	if err := copied.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "moderator"); err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	cookies := loginCookies(t, auth, "user")
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "admin", false); err != nil {
+		t.Fatalf("AuthorizeRole: updated level not applied: %v", err)
+	}
+
+	var inUse *RoleInUseError
+	if err := auth.DeleteRole("moderator"); !errors.As(err, &inUse) || !reflect.DeepEqual(inUse.Users, []string{"user"}) {
+		t.Fatalf("DeleteRole: expected *RoleInUseError for user, got %v", err)
+	}
+	if err := auth.DeleteRole("user"); !errors.Is(err, ErrRoleInUse) {
+		t.Fatalf("DeleteRole: expected ErrRoleInUse for default role, got %v", err)
+	}
+
+	if err := auth.RenameRole("moderator", "mod,editor"); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("RenameRole: expected ErrInvalidRole for comma, got %v", err)
+	}
+	if err := auth.RenameRole("moderator", "admin"); !errors.Is(err, ErrRoleExists) {
+		t.Fatalf("RenameRole: expected ErrRoleExists, got %v", err)
+	}
+	if err := auth.RenameRole("moderator", "editor"); err != nil {
+		t.Fatalf("RenameRole: %v", err)
+	}
+	if user, _ := auth.backend.User("user"); user.Role != "editor" {
+		t.Fatalf("RenameRole: user not moved, has role %q", user.Role)
+	}
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", cookies), "editor", false); err != nil {
+		t.Fatalf("AuthorizeRole: %v", err)
+	}
+	if err := auth.RenameRole("user", "member"); err != nil {
+		t.Fatalf("RenameRole: %v", err)
+	}
+	if err := auth.Register(httptest.NewRecorder(), newTestRequest("POST", nil), UserData{Username: "new", Email: "new@example.com"}, "password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if user, _ := auth.backend.User("new"); user.Role != "member" {
+		t.Fatalf("Register: expected renamed default role, got %q", user.Role)
+	}
+
+	if err := auth.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "admin"); err != nil {
+		t.Fatalf("ChangeRole: %v", err)
+	}
+	if err := auth.DeleteRole("editor"); err != nil {
+		t.Fatalf("DeleteRole: %v", err)
+	}
+	if _, ok := auth.Roles()["editor"]; ok {
+		t.Fatal("DeleteRole: role still listed")
+	}
+}
+
+func TestRolesPersisted(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	other, err := NewAuthorizer(auth.backend, []byte("testkey"), "user", map[string]Role{"user": 1})
+	if err != nil {
+		t.Fatalf("NewAuthorizer: %v", err)
+	}
+	if err := auth.AddRole("moderator", 60); err != nil {
+		t.Fatalf("AddRole: %v", err)
+	}
+	if _, ok := other.Roles()["moderator"]; ok {
+		t.Fatal("Roles: other Authorizer changed before ReloadRoles")
+	}
+	if err := other.ReloadRoles(); err != nil {
+		t.Fatalf("ReloadRoles: %v", err)
+	}
+	want := map[string]Role{"user": 40, "admin": 80, "moderator": 60}
+	if roles := other.Roles(); !reflect.DeepEqual(roles, want) {
+		t.Fatalf("ReloadRoles: expected %v, got %v", want, roles)
+	}
+
+	// Stored levels take precedence over the ones passed in.
+	restarted, err := NewAuthorizer(auth.backend, []byte("testkey"), "user", map[string]Role{"user": 1, "guest": 10})
+	if err != nil {
+		t.Fatalf("NewAuthorizer: %v", err)
+	}
+	want["guest"] = 10
+	if roles := restarted.Roles(); !reflect.DeepEqual(roles, want) {
+		t.Fatalf("Roles: expected %v, got %v", want, roles)
+	}
+}
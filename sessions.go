@@ -0,0 +1,423 @@
+package httpauth
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ErrNoSessionStore is returned when listing or revoking sessions without a
+// SessionStore configured.
+// ErrSessionNotFound is returned by SessionStores for unknown session IDs.
+// ErrSessionRevoked is returned by Authorize for sessions ended by LogoutAll.
+var (
+	ErrNoSessionStore  = mkerror("no session store configured")
+	ErrSessionNotFound = mkerror("session not found")
+	ErrSessionRevoked  = mkerror("session revoked")
+)
+
+// How often the last seen time of a session is written back to the store.
+const sessionTouchInterval = time.Minute
+
+// SessionRecord is a login session kept in a SessionStore.
+type SessionRecord struct {
+	ID        string
+	Username  string // empty while a login waits for its second factor
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	IP        string
+	UserAgent string
+	Data      string // encoded session values, opaque to stores
+}
+
+// SessionStore stores SessionRecords by ID, so that sessions can be listed and
+// revoked.
+//
+// MemorySessionStore keeps records in memory. The SQL and leveldb
+// AuthBackends also implement SessionStore, persisting records next to the
+// users.
+type SessionStore interface {
+	// Session returns the record with the given ID, or ErrSessionNotFound.
+	Session(id string) (SessionRecord, error)
+	SaveSession(r SessionRecord) error
+	DeleteSession(id string) error
+	// UserSessions returns all records of username, in any order.
+	UserSessions(username string) ([]SessionRecord, error)
+	DeleteUserSessions(username string) error
+	// DeleteExpiredSessions removes all records that expired before the
+	// given time.
+	DeleteExpiredSessions(before time.Time) error
+}
+
+// MemorySessionStore is a SessionStore keeping records in memory. It is safe
+// for concurrent use.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]SessionRecord
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]SessionRecord)}
+}
+
+// Session returns the record with the given ID.
+func (s *MemorySessionStore) Session(id string) (SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.sessions[id]
+	if !ok {
+		return r, ErrSessionNotFound
+	}
+	return r, nil
+}
+
+// SaveSession adds or replaces a record.
+func (s *MemorySessionStore) SaveSession(r SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[r.ID] = r
+	return nil
+}
+
+// DeleteSession removes the record with the given ID.
+func (s *MemorySessionStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// UserSessions returns all records of username.
+func (s *MemorySessionStore) UserSessions(username string) ([]SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rs []SessionRecord
+	for _, r := range s.sessions {
+		if r.Username == username {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+// DeleteUserSessions removes all records of username.
+func (s *MemorySessionStore) DeleteUserSessions(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, r := range s.sessions {
+		if r.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredSessions removes all expired records.
+func (s *MemorySessionStore) DeleteExpiredSessions(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, r := range s.sessions {
+		if r.Expires.Before(before) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// SetSessionStore keeps "auth" sessions in store instead of entirely in the
+// cookie, which then only holds a signed session ID. This allows listing and
+// revoking sessions. Pass nil to go back to cookie sessions.
+//
+// Expired records are only removed when they are read again, and visitors
+// who never log in get records too (see CSRFOptions), so call
+// DeleteExpiredSessions periodically.
+//
+// Switching stores logs out all users.
+func (a *Authorizer) SetSessionStore(store SessionStore) {
+	a.sessionStore = store
+	if store == nil {
+		a.authStore = a.cookiejar
+		return
+	}
+	a.authStore = &serverStore{store: store, codecs: a.cookiejar.Codecs, options: a.cookiejar.Options}
+}
+
+// Sessions returns the active sessions of username, most recently seen first.
+func (a Authorizer) Sessions(username string) ([]SessionRecord, error) {
+	if a.sessionStore == nil {
+		return nil, ErrNoSessionStore
+	}
+	rs, err := a.sessionStore.UserSessions(username)
+	if err != nil {
+		return nil, backendError(err)
+	}
+	now := time.Now()
+	active := rs[:0]
+	for _, r := range rs {
+		if now.After(r.Expires) {
+			a.sessionStore.DeleteSession(r.ID)
+			continue
+		}
+		active = append(active, r)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].LastSeen.After(active[j].LastSeen) })
+	return active, nil
+}
+
+// DeleteExpiredSessions removes the records of expired sessions from the
+// SessionStore.
+func (a Authorizer) DeleteExpiredSessions() error {
+	if a.sessionStore == nil {
+		return ErrNoSessionStore
+	}
+	return backendError(a.sessionStore.DeleteExpiredSessions(time.Now()))
+}
+
+// CurrentSessionID returns the ID of the request's session, if it is kept in
+// a SessionStore.
+func (a Authorizer) CurrentSessionID(req *http.Request) (string, bool) {
+	if a.sessionStore == nil {
+		return "", false
+	}
+	session, err := a.authSession(req)
+	if err != nil || session.IsNew {
+		return "", false
+	}
+	return session.ID, true
+}
+
+// RevokeSession logs out the session with the given ID.
+func (a Authorizer) RevokeSession(id string) error {
+	if a.sessionStore == nil {
+		return ErrNoSessionStore
+	}
+	return backendError(a.sessionStore.DeleteSession(id))
+}
+
+// RevokeSessions logs out all sessions of username.
+func (a Authorizer) RevokeSessions(username string) error {
+	if a.sessionStore == nil {
+		return ErrNoSessionStore
+	}
+	return backendError(a.sessionStore.DeleteUserSessions(username))
+}
+
+// LogoutAll ends every session of username, in all browsers. This works with
+// cookie sessions too: it increments the user's SessionGeneration, and
+// Authorize rejects sessions started with an older one. If a SessionStore is
+// set, the user's sessions are also removed from it.
+func (a Authorizer) LogoutAll(username string) error {
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
+		return backendError(err)
+	}
+	user.SessionGeneration++
+	if err := a.backend.SaveUser(user); err != nil {
+		return backendError(err)
+	}
+	a.emit(nil, Event{Type: EventLogoutAll, Username: username})
+	if a.sessionStore != nil {
+		return backendError(a.sessionStore.DeleteUserSessions(username))
+	}
+	return nil
+}
+
+// regenerateSession empties session and drops its ID, so that saving it
+// issues a new one. Called whenever a session gains privileges, this keeps
+// an ID or cookie planted before then (session fixation) from sharing them.
+func (a Authorizer) regenerateSession(session *sessions.Session) {
+	if session.ID != "" && a.sessionStore != nil {
+		if err := a.sessionStore.DeleteSession(session.ID); err != nil {
+			a.logf("couldn't delete session: %v", err)
+		}
+	}
+	session.ID = ""
+	session.IsNew = true
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+}
+
+// startSession logs user in on a regenerated session. The caller saves it.
+func (a Authorizer) startSession(session *sessions.Session, user UserData) {
+	a.regenerateSession(session)
+	session.Values["username"] = user.Username
+	session.Values["generation"] = user.SessionGeneration
+	stampSession(session, time.Now())
+}
+
+// rotateSessions is called once user has been saved with an incremented
+// SessionGeneration after a change of password or role. It removes the
+// user's sessions from the SessionStore and, if req belongs to user, logs it
+// in again on a new session so that it survives. rw and req may be nil.
+func (a Authorizer) rotateSessions(rw http.ResponseWriter, req *http.Request, user UserData) {
+	// Load the request's session before its record is deleted.
+	var session *sessions.Session
+	if req != nil {
+		session, _ = a.authSession(req)
+	}
+	if a.sessionStore != nil {
+		if err := a.sessionStore.DeleteUserSessions(user.Username); err != nil {
+			a.logf("couldn't delete sessions of %s: %v", user.Username, err)
+		}
+	}
+	if session == nil {
+		return
+	}
+	if username, _ := session.Values["username"].(string); username != user.Username {
+		return
+	}
+	// Timeouts still count from the original login.
+	issued := session.Values["issued"]
+	a.startSession(session, user)
+	if issued != nil {
+		session.Values["issued"] = issued
+	}
+	session.Save(req, rw)
+}
+
+// LogoutAllHandler returns a handler that lets users with at least the given
+// role end all sessions of another user with LogoutAll. It takes POST requests
+// with the username in the "username" form value, and answers with 204 No
+// Content. Requests are authorized like RequireRole does.
+func (a Authorizer) LogoutAllHandler(role string) http.Handler {
+	return a.RequireRole(role, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		err := a.LogoutAll(req.FormValue("username"))
+		if err == ErrUserNotFound {
+			a.apiError(rw, http.StatusNotFound, CodeUserNotFound, "User doesn't exist.")
+			if !a.apiMode {
+				http.Error(rw, "User doesn't exist.", http.StatusNotFound)
+			}
+			return
+		} else if err != nil {
+			a.backendFailure(rw, err)
+			if !a.apiMode {
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// serverStore is a sessions.Store keeping session values in a SessionStore,
+// and only their signed ID in the cookie. It works like
+// sessions.FilesystemStore.
+type serverStore struct {
+	store   SessionStore
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+// Get returns the named session, registering it for the request.
+func (s *serverStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(s, name)
+}
+
+// New loads the named session. Unknown and expired sessions are returned as
+// new ones. The record's last seen time, IP and user agent are updated.
+func (s *serverStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.codecs...); err != nil {
+		return session, err
+	}
+	r, err := s.store.Session(id)
+	if err == ErrSessionNotFound {
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	now := time.Now()
+	if now.After(r.Expires) {
+		s.store.DeleteSession(id)
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, r.Data, &session.Values, s.codecs...); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	if now.Sub(r.LastSeen) > sessionTouchInterval || r.IP != clientIP(req) || r.UserAgent != req.UserAgent() {
+		r.LastSeen, r.IP, r.UserAgent = now, clientIP(req), req.UserAgent()
+		s.store.SaveSession(r)
+	}
+	return session, nil
+}
+
+// Save writes the session to the store and its ID to the response. Sessions
+// with a negative MaxAge are deleted. A session whose record disappeared
+// since it was loaded was revoked, so it is saved as a new, empty one rather
+// than brought back.
+func (s *serverStore) Save(req *http.Request, rw http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.store.DeleteSession(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(rw, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	now := time.Now()
+	r := SessionRecord{ID: session.ID, Created: now}
+	if session.ID != "" {
+		old, err := s.store.Session(session.ID)
+		if err == ErrSessionNotFound {
+			session.ID = ""
+			session.Values = make(map[interface{}]interface{})
+		} else if err == nil {
+			r.Created = old.Created
+		}
+	}
+	if session.ID == "" {
+		b, err := randomBytes(32)
+		if err != nil {
+			return err
+		}
+		r.ID = hex.EncodeToString(b)
+	}
+	r.Username, _ = session.Values["username"].(string)
+	r.LastSeen, r.IP, r.UserAgent = now, clientIP(req), req.UserAgent()
+	lifetime := time.Duration(session.Options.MaxAge) * time.Second
+	if lifetime == 0 {
+		lifetime = 24 * time.Hour
+	}
+	r.Expires = now.Add(lifetime)
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
+	if err != nil {
+		return err
+	}
+	r.Data = data
+	if err := s.store.SaveSession(r); err != nil {
+		return err
+	}
+	session.ID = r.ID
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(rw, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
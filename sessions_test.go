@@ -0,0 +1,263 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSessionStore(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	if _, err := auth.Sessions("user"); !errors.Is(err, ErrNoSessionStore) {
+		t.Fatalf("Sessions: expected ErrNoSessionStore, got %v", err)
+	}
+	auth.SetSessionStore(NewMemorySessionStore())
+
+	first := loginCookies(t, auth, "user")
+	second := loginCookies(t, auth, "user")
+	sessions, err := auth.Sessions("user")
+	if err != nil {
+		t.Fatalf("Sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Sessions: expected 2 sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Username != "user" || s.Created.IsZero() || s.LastSeen.IsZero() {
+			t.Fatalf("Sessions: incomplete record %+v", s)
+		}
+	}
+
+	id, ok := auth.CurrentSessionID(newTestRequest("GET", first))
+	if !ok {
+		t.Fatal("CurrentSessionID: no session")
+	}
+	if err := auth.RevokeSession(id); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", first), false); err == nil {
+		t.Fatal("Authorize: revoked session accepted")
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", second), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	admin := loginCookies(t, auth, "admin")
+	if err := auth.RevokeSessions("user"); err != nil {
+		t.Fatalf("RevokeSessions: %v", err)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", second), false); err == nil {
+		t.Fatal("Authorize: revoked session accepted")
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", admin), false); err != nil {
+		t.Fatalf("Authorize: other user's session revoked: %v", err)
+	}
+
+	auth.Logout(httptest.NewRecorder(), newTestRequest("GET", admin))
+	if sessions, _ := auth.Sessions("admin"); len(sessions) != 0 {
+		t.Fatal("Logout: session not removed from store")
+	}
+}
+
+func TestRevokedSessionNotResaved(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetSessionStore(NewMemorySessionStore())
+	cookies := loginCookies(t, auth, "user")
+
+	// Revoke the session while a request using it is being handled, which
+	// then saves it.
+	req := newTestRequest("GET", cookies)
+	if err := auth.Authorize(httptest.NewRecorder(), req, false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	id, _ := auth.CurrentSessionID(req)
+	if err := auth.RevokeSession(id); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	rw := httptest.NewRecorder()
+	if _, err := auth.CSRFToken(rw, req); err != nil {
+		t.Fatalf("CSRFToken: %v", err)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); err == nil {
+		t.Fatal("Authorize: revoked session accepted with the old cookie")
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", rw.Result().Cookies()), false); err == nil {
+		t.Fatal("Authorize: revoked session accepted with the new cookie")
+	}
+	if sessions, _ := auth.Sessions("user"); len(sessions) != 0 {
+		t.Fatalf("Sessions: revoked session saved again: %+v", sessions)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	first := loginCookies(t, auth, "user")
+	second := loginCookies(t, auth, "user")
+	admin := loginCookies(t, auth, "admin")
+
+	if err := auth.LogoutAll("user"); err != nil {
+		t.Fatalf("LogoutAll: %v", err)
+	}
+	for _, cookies := range [][]*http.Cookie{first, second} {
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); !errors.Is(err, ErrSessionRevoked) {
+			t.Fatalf("Authorize: expected ErrSessionRevoked, got %v", err)
+		}
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", admin), false); err != nil {
+		t.Fatalf("Authorize: other user's session revoked: %v", err)
+	}
+	loginCookies(t, auth, "user")
+	if err := auth.LogoutAll("nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("LogoutAll: expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestLogoutAllHandler(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetSessionStore(NewMemorySessionStore())
+	user := loginCookies(t, auth, "user")
+	handler := auth.LogoutAllHandler("admin")
+
+	post := func(cookies []*http.Cookie, username string) int {
+		req := httptest.NewRequest("POST", "/logout-all", strings.NewReader(url.Values{"username": {username}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if code := post(user, "admin"); code != http.StatusForbidden {
+		t.Fatalf("LogoutAllHandler: expected 403 for user, got %d", code)
+	}
+	admin := loginCookies(t, auth, "admin")
+	if code := post(admin, "nobody"); code != http.StatusNotFound {
+		t.Fatalf("LogoutAllHandler: expected 404, got %d", code)
+	}
+	if code := post(admin, "user"); code != http.StatusNoContent {
+		t.Fatalf("LogoutAllHandler: expected 204, got %d", code)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", user), false); err == nil {
+		t.Fatal("Authorize: session survived LogoutAllHandler")
+	}
+}
+
+// sessionStoreModes runs f with cookie sessions and with a SessionStore.
+func sessionStoreModes(t *testing.T, f func(t *testing.T, auth Authorizer)) {
+	t.Run("cookie", func(t *testing.T) { f(t, newTestAuthorizer(t)) })
+	t.Run("store", func(t *testing.T) {
+		auth := newTestAuthorizer(t)
+		auth.SetSessionStore(NewMemorySessionStore())
+		f(t, auth)
+	})
+}
+
+func TestLoginRegeneratesSession(t *testing.T) {
+	sessionStoreModes(t, func(t *testing.T, auth Authorizer) {
+		// An attacker gets a session and plants its cookie in the victim's
+		// browser.
+		rw := httptest.NewRecorder()
+		req := newTestRequest("GET", nil)
+		session, _ := auth.authSession(req)
+		session.Values["planted"] = true
+		session.Save(req, rw)
+		planted := rw.Result().Cookies()
+		plantedID, _ := auth.CurrentSessionID(newTestRequest("GET", planted))
+
+		rw = httptest.NewRecorder()
+		req = newTestRequest("POST", planted)
+		if err := auth.Login(rw, req, "user", "password", ""); err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		cookies := rw.Result().Cookies()
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", planted), false); err == nil {
+			t.Fatal("Authorize: planted cookie logged in")
+		}
+		if id, ok := auth.CurrentSessionID(newTestRequest("GET", cookies)); ok && id == plantedID {
+			t.Fatal("Login: session ID not changed")
+		}
+		session, _ = auth.authSession(newTestRequest("GET", cookies))
+		if _, ok := session.Values["planted"]; ok {
+			t.Fatal("Login: values from before login kept")
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+	})
+}
+
+func TestPasswordChangeRotatesSessions(t *testing.T) {
+	sessionStoreModes(t, func(t *testing.T, auth Authorizer) {
+		current := loginCookies(t, auth, "user")
+		other := loginCookies(t, auth, "user")
+		oldID, _ := auth.CurrentSessionID(newTestRequest("GET", current))
+
+		rw := httptest.NewRecorder()
+		if err := auth.Update(rw, newTestRequest("POST", current), "newpassword", ""); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		rotated := rw.Result().Cookies()
+		for _, cookies := range [][]*http.Cookie{current, other} {
+			if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", cookies), false); err == nil {
+				t.Fatal("Authorize: old session survived password change")
+			}
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", rotated), false); err != nil {
+			t.Fatalf("Authorize: current session lost: %v", err)
+		}
+		if id, ok := auth.CurrentSessionID(newTestRequest("GET", rotated)); ok && id == oldID {
+			t.Fatal("Update: session ID not changed")
+		}
+
+		// Changing only the email address keeps sessions.
+		if err := auth.Update(httptest.NewRecorder(), newTestRequest("POST", rotated), "", "new@example.com"); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", rotated), false); err != nil {
+			t.Fatalf("Authorize: session ended by email change: %v", err)
+		}
+	})
+}
+
+func TestChangeRole(t *testing.T) {
+	sessionStoreModes(t, func(t *testing.T, auth Authorizer) {
+		user := loginCookies(t, auth, "user")
+		admin := loginCookies(t, auth, "admin")
+
+		if err := auth.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", admin), "nobody", "admin"); err != ErrUserNotFound {
+			t.Fatalf("ChangeRole: expected ErrUserNotFound, got %v", err)
+		}
+		if err := auth.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", admin), "user", "root"); !errors.Is(err, ErrRoleNotFound) {
+			t.Fatalf("ChangeRole: expected ErrRoleNotFound, got %v", err)
+		}
+		if err := auth.ChangeRole(httptest.NewRecorder(), newTestRequest("POST", admin), "user", "admin"); err != nil {
+			t.Fatalf("ChangeRole: %v", err)
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", user), false); err == nil {
+			t.Fatal("Authorize: session survived role change")
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", admin), false); err != nil {
+			t.Fatalf("Authorize: other user's session ended: %v", err)
+		}
+
+		// Users changing their own role stay logged in on a new session.
+		rw := httptest.NewRecorder()
+		if err := auth.ChangeRole(rw, newTestRequest("POST", admin), "admin", "user"); err != nil {
+			t.Fatalf("ChangeRole: %v", err)
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", admin), false); err == nil {
+			t.Fatal("Authorize: old session survived role change")
+		}
+		rotated := rw.Result().Cookies()
+		if err := auth.AuthorizeRole(httptest.NewRecorder(), newTestRequest("GET", rotated), "admin", false); err == nil {
+			t.Fatal("AuthorizeRole: old role still in effect")
+		}
+		if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", rotated), false); err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+	})
+}
@@ -2,9 +2,13 @@ package httpauth
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 )
 
 // SqlAuthBackend database and database connection information.
@@ -16,18 +20,178 @@ type SqlAuthBackend struct {
 	// prepared statements
 	userStmt   *sql.Stmt
 	usersStmt  *sql.Stmt
+	emailStmt  *sql.Stmt
 	insertStmt *sql.Stmt
 	updateStmt *sql.Stmt
 	deleteStmt *sql.Stmt
+
+	failuresStmt       *sql.Stmt
+	insertFailuresStmt *sql.Stmt
+	updateFailuresStmt *sql.Stmt
+	resetFailuresStmt  *sql.Stmt
+
+	sessionStmt            *sql.Stmt
+	userSessionsStmt       *sql.Stmt
+	insertSessionStmt      *sql.Stmt
+	updateSessionStmt      *sql.Stmt
+	deleteSessionStmt      *sql.Stmt
+	deleteUserSessionsStmt *sql.Stmt
+	deleteExpiredStmt      *sql.Stmt
+
+	rolesStmt      *sql.Stmt
+	roleStmt       *sql.Stmt
+	insertRoleStmt *sql.Stmt
+	updateRoleStmt *sql.Stmt
+	deleteRoleStmt *sql.Stmt
+
+	groupsStmt      *sql.Stmt
+	groupStmt       *sql.Stmt
+	insertGroupStmt *sql.Stmt
+	updateGroupStmt *sql.Stmt
+	deleteGroupStmt *sql.Stmt
+}
+
+type sqlColumn struct {
+	name       string
+	definition string
+}
+
+// baseUserColumns are the columns of the original goauth table, besides
+// Username.
+var baseUserColumns = []sqlColumn{
+	{"Email", "varchar(255)"},
+	{"Hash", "varchar(255)"},
+	{"Role", "varchar(255)"},
+}
+
+// userColumns are goauth columns added since, which are created on tables
+// that don't have them yet.
+var userColumns = []sqlColumn{
+	{"TOTPSecret", "varchar(255) not null default ''"},
+	{"TOTPEnabled", "boolean not null default false"},
+	{"RecoveryCodes", "varchar(1024) not null default ''"},
+	{"EmailVerified", "boolean not null default false"},
+	{"LoginNonce", "varchar(255) not null default ''"},
+	{"SessionGeneration", "integer not null default 0"},
+	{"Roles", "varchar(1024) not null default ''"},
+	{"UserGroups", "varchar(1024) not null default ''"}, // GROUPS is reserved in MySQL
+	{"Attributes", "varchar(2048) not null default ''"},
+	{"TOTPLastStep", "bigint not null default 0"},
+	{"SecondFactorFailures", "integer not null default 0"},
+	{"SecondFactorFailedAt", "bigint not null default 0"},
+}
+
+// roleColumns are goauth_roles columns added since, which are created on
+// tables that don't have them yet.
+var roleColumns = []sqlColumn{
+	{"Permissions", "varchar(1024) not null default ''"},
+	{"Inherits", "varchar(1024) not null default ''"},
+}
+
+// userFields returns pointers to the fields of user stored in the columns of
+// baseUserColumns and userColumns, in order. They're used both to scan rows
+// and as statement arguments.
+func userFields(user *UserData) []interface{} {
+	return []interface{}{
+		&user.Email, &user.Hash, &user.Role,
+		&user.TOTPSecret, &user.TOTPEnabled, (*stringList)(&user.RecoveryCodes),
+		&user.EmailVerified, &user.LoginNonce, &user.SessionGeneration,
+		(*stringList)(&user.Roles), (*stringList)(&user.Groups), (*stringMap)(&user.Attributes),
+		&user.TOTPLastStep, &user.SecondFactorFailures, &user.SecondFactorFailedAt,
+	}
+}
+
+// stringList stores a []string in a single column, separated by commas.
+type stringList []string
+
+// Scan implements sql.Scanner.
+func (l *stringList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("sqlbackend: can't scan %T into a list", src)
+	}
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (l stringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+// stringMap stores a map[string]string in a single column, as JSON.
+type stringMap map[string]string
+
+// Scan implements sql.Scanner.
+func (m *stringMap) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case nil:
+	default:
+		return fmt.Errorf("sqlbackend: can't scan %T into a map", src)
+	}
+	*m = nil
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, m)
+}
+
+// Value implements driver.Valuer.
+func (m stringMap) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(m)
+	return string(data), err
 }
 
 func mksqlerror(msg string) error {
 	return errors.New("sqlbackend: " + msg)
 }
 
+// prepare prepares a query written with ? placeholders.
+//
+// NOTE:
+// I don't want to have to check if it's postgres, but postgres uses
+// different tokens for placeholders. :( Also be aware that postgres
+// lowercases all these column names.
+//
+// Thanks to mjhall for letting me know about this.
+func (b SqlAuthBackend) prepare(query string) (*sql.Stmt, error) {
+	if b.driverName == "postgres" {
+		var buf strings.Builder
+		n := 0
+		for _, c := range query {
+			if c == '?' {
+				n++
+				fmt.Fprintf(&buf, "$%d", n)
+			} else {
+				buf.WriteRune(c)
+			}
+		}
+		query = buf.String()
+	}
+	return b.db.Prepare(query)
+}
+
 // NewSqlAuthBackend initializes a new backend by testing the database
-// connection and making sure the storage table exists. The table is called
-// goauth.
+// connection and making sure the storage tables exist. Users are stored in a
+// table called goauth, login failure records in goauth_failures, sessions in
+// goauth_sessions, roles in goauth_roles and groups in goauth_groups.
 //
 // Returns an error if connecting to the database fails, pinging the database
 // fails, or creating the table fails.
@@ -60,67 +224,102 @@ func NewSqlAuthBackend(driverName, dataSourceName string) (b SqlAuthBackend, e e
 	if err != nil {
 		return b, mksqlerror(err.Error())
 	}
+	if err = addMissingColumns(db, "goauth", userColumns); err != nil {
+		return b, err
+	}
+
+	_, err = db.Exec(`create table if not exists goauth_failures (Name varchar(255), FailCount integer, FirstFailure bigint, LastFailure bigint, LockedUntil bigint, primary key (Name))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+	_, err = db.Exec(`create table if not exists goauth_sessions (ID varchar(64), Username varchar(255), Created bigint, LastSeen bigint, Expires bigint, IP varchar(64), UserAgent varchar(1024), Data text, primary key (ID))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+	_, err = db.Exec(`create table if not exists goauth_roles (Name varchar(255), Level integer, primary key (Name))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+	if err = addMissingColumns(db, "goauth_roles", roleColumns); err != nil {
+		return b, err
+	}
+	_, err = db.Exec(`create table if not exists goauth_groups (Name varchar(255), Roles varchar(1024), primary key (Name))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
 
 	// prepare statements for concurrent use and better preformance
-	//
-	// NOTE:
-	// I don't want to have to check if it's postgres, but postgres uses
-	// different tokens for placeholders. :( Also be aware that postgres
-	// lowercases all these column names.
-	//
-	// Thanks to mjhall for letting me know about this.
-	if driverName == "postgres" {
-		b.userStmt, err = db.Prepare(`select Email, Hash, Role from goauth where Username = $1`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("userstmt: %v", err))
-		}
-		b.usersStmt, err = db.Prepare(`select Username, Email, Hash, Role from goauth`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("usersstmt: %v", err))
-		}
-		b.insertStmt, err = db.Prepare(`insert into goauth (Username, Email, Hash, Role) values ($1, $2, $3, $4)`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("insertstmt: %v", err))
-		}
-		b.updateStmt, err = db.Prepare(`update goauth set Email = $1, Hash = $2, Role = $3 where Username = $4`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("updatestmt: %v", err))
-		}
-		b.deleteStmt, err = db.Prepare(`delete from goauth where Username = $1`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("deletestmt: %v", err))
-		}
-	} else {
-		b.userStmt, err = db.Prepare(`select Email, Hash, Role from goauth where Username = ?`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("userstmt: %v", err))
-		}
-		b.usersStmt, err = db.Prepare(`select Username, Email, Hash, Role from goauth`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("usersstmt: %v", err))
-		}
-		b.insertStmt, err = db.Prepare(`insert into goauth (Username, Email, Hash, Role) values (?, ?, ?, ?)`)
+	var names, marks, sets []string
+	for _, c := range append(baseUserColumns, userColumns...) {
+		names = append(names, c.name)
+		marks = append(marks, "?")
+		sets = append(sets, c.name+" = ?")
+	}
+	columns := strings.Join(names, ", ")
+	placeholders := strings.Join(marks, ", ")
+	assignments := strings.Join(sets, ", ")
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		name  string
+		query string
+	}{
+		{&b.userStmt, "userstmt", `select ` + columns + ` from goauth where Username = ?`},
+		{&b.usersStmt, "usersstmt", `select Username, ` + columns + ` from goauth`},
+		{&b.emailStmt, "emailstmt", `select Username, ` + columns + ` from goauth where Email = ?`},
+		{&b.insertStmt, "insertstmt", `insert into goauth (` + columns + `, Username) values (` + placeholders + `, ?)`},
+		{&b.updateStmt, "updatestmt", `update goauth set ` + assignments + ` where Username = ?`},
+		{&b.deleteStmt, "deletestmt", `delete from goauth where Username = ?`},
+		{&b.failuresStmt, "failuresstmt", `select FailCount, FirstFailure, LastFailure, LockedUntil from goauth_failures where Name = ?`},
+		{&b.insertFailuresStmt, "insertfailuresstmt", `insert into goauth_failures (FailCount, FirstFailure, LastFailure, LockedUntil, Name) values (?, ?, ?, ?, ?)`},
+		{&b.updateFailuresStmt, "updatefailuresstmt", `update goauth_failures set FailCount = ?, FirstFailure = ?, LastFailure = ?, LockedUntil = ? where Name = ?`},
+		{&b.resetFailuresStmt, "resetfailuresstmt", `delete from goauth_failures where Name = ?`},
+		{&b.sessionStmt, "sessionstmt", `select ` + sessionColumns + ` from goauth_sessions where ID = ?`},
+		{&b.userSessionsStmt, "usersessionsstmt", `select ` + sessionColumns + ` from goauth_sessions where Username = ?`},
+		{&b.insertSessionStmt, "insertsessionstmt", `insert into goauth_sessions (Username, Created, LastSeen, Expires, IP, UserAgent, Data, ID) values (?, ?, ?, ?, ?, ?, ?, ?)`},
+		{&b.updateSessionStmt, "updatesessionstmt", `update goauth_sessions set Username = ?, Created = ?, LastSeen = ?, Expires = ?, IP = ?, UserAgent = ?, Data = ? where ID = ?`},
+		{&b.deleteSessionStmt, "deletesessionstmt", `delete from goauth_sessions where ID = ?`},
+		{&b.deleteUserSessionsStmt, "deleteusersessionsstmt", `delete from goauth_sessions where Username = ?`},
+		{&b.deleteExpiredStmt, "deleteexpiredstmt", `delete from goauth_sessions where Expires < ?`},
+		{&b.rolesStmt, "rolesstmt", `select Name, Level, Permissions, Inherits from goauth_roles`},
+		{&b.roleStmt, "rolestmt", `select Level from goauth_roles where Name = ?`},
+		{&b.insertRoleStmt, "insertrolestmt", `insert into goauth_roles (Level, Permissions, Inherits, Name) values (?, ?, ?, ?)`},
+		{&b.updateRoleStmt, "updaterolestmt", `update goauth_roles set Level = ?, Permissions = ?, Inherits = ? where Name = ?`},
+		{&b.deleteRoleStmt, "deleterolestmt", `delete from goauth_roles where Name = ?`},
+		{&b.groupsStmt, "groupsstmt", `select Name, Roles from goauth_groups`},
+		{&b.groupStmt, "groupstmt", `select Name from goauth_groups where Name = ?`},
+		{&b.insertGroupStmt, "insertgroupstmt", `insert into goauth_groups (Roles, Name) values (?, ?)`},
+		{&b.updateGroupStmt, "updategroupstmt", `update goauth_groups set Roles = ? where Name = ?`},
+		{&b.deleteGroupStmt, "deletegroupstmt", `delete from goauth_groups where Name = ?`},
+	} {
+		*s.stmt, err = b.prepare(s.query)
 		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("insertstmt: %v", err))
+			return b, mksqlerror(fmt.Sprintf("%v: %v", s.name, err))
 		}
-		b.updateStmt, err = db.Prepare(`update goauth set Email = ?, Hash = ?, Role = ? where Username = ?`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("updatestmt: %v", err))
+	}
+
+	return b, nil
+}
+
+// addMissingColumns adds columns missing from tables created by older
+// versions.
+func addMissingColumns(db *sql.DB, table string, columns []sqlColumn) error {
+	for _, c := range columns {
+		if _, err := db.Exec(`select ` + c.name + ` from ` + table + ` where 1 = 0`); err == nil {
+			continue
 		}
-		b.deleteStmt, err = db.Prepare(`delete from goauth where Username = ?`)
+		_, err := db.Exec(`alter table ` + table + ` add column ` + c.name + ` ` + c.definition)
 		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("deletestmt: %v", err))
+			return mksqlerror(fmt.Sprintf("adding column %v: %v", c.name, err))
 		}
 	}
-
-	return b, nil
+	return nil
 }
 
 // User returns the user with the given username. Error is set to
 // ErrMissingUser if user is not found.
 func (b SqlAuthBackend) User(username string) (user UserData, e error) {
 	row := b.userStmt.QueryRow(username)
-	err := row.Scan(&user.Email, &user.Hash, &user.Role)
+	err := row.Scan(userFields(&user)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return user, ErrMissingUser
@@ -128,37 +327,51 @@ func (b SqlAuthBackend) User(username string) (user UserData, e error) {
 		return user, mksqlerror(err.Error())
 	}
 	user.Username = username
+	migrateRoles(&user)
 	return user, nil
 }
 
 // Users returns a slice of all users.
 func (b SqlAuthBackend) Users() (us []UserData, e error) {
-	rows, err := b.usersStmt.Query()
+	return scanUsers(b.usersStmt.Query())
+}
+
+// UsersByEmail returns the users with the given email address.
+func (b SqlAuthBackend) UsersByEmail(email string) (us []UserData, e error) {
+	return scanUsers(b.emailStmt.Query(email))
+}
+
+// scanUsers reads the users returned by a query selecting the username and
+// the columns of userFields.
+func scanUsers(rows *sql.Rows, err error) (us []UserData, e error) {
 	if err != nil {
 		return us, mksqlerror(err.Error())
 	}
-	var (
-		username, email, role string
-		hash                  []byte
-	)
+	defer rows.Close()
 	for rows.Next() {
-		err = rows.Scan(&username, &email, &hash, &role)
+		var user UserData
+		err = rows.Scan(append([]interface{}{&user.Username}, userFields(&user)...)...)
 		if err != nil {
 			return us, mksqlerror(err.Error())
 		}
-		us = append(us, UserData{username, email, hash, role})
+		migrateRoles(&user)
+		us = append(us, user)
 	}
 	return us, nil
 }
 
 // SaveUser adds a new user, replacing one with the same username.
 func (b SqlAuthBackend) SaveUser(user UserData) (err error) {
-	if _, err := b.User(user.Username); err == nil {
-		_, err = b.updateStmt.Exec(user.Email, user.Hash, user.Role, user.Username)
+	args := append(userFields(&user), user.Username)
+	if _, e := b.User(user.Username); e == nil {
+		_, err = b.updateStmt.Exec(args...)
 	} else {
-		_, err = b.insertStmt.Exec(user.Username, user.Email, user.Hash, user.Role)
+		_, err = b.insertStmt.Exec(args...)
+	}
+	if err != nil {
+		return mksqlerror(err.Error())
 	}
-	return
+	return nil
 }
 
 // DeleteUser removes a user, raising ErrDeleteNull if that user was missing.
@@ -177,12 +390,238 @@ func (b SqlAuthBackend) DeleteUser(username string) error {
 	return nil
 }
 
+// Failures returns the login failure record for key.
+func (b SqlAuthBackend) Failures(key string) (r FailureRecord, e error) {
+	var first, last, locked int64
+	err := b.failuresStmt.QueryRow(key).Scan(&r.Count, &first, &last, &locked)
+	if err == sql.ErrNoRows {
+		return r, nil
+	} else if err != nil {
+		return r, mksqlerror(err.Error())
+	}
+	r.First, r.Last, r.LockedUntil = fromUnixNano(first), fromUnixNano(last), fromUnixNano(locked)
+	return r, nil
+}
+
+// SaveFailures replaces the login failure record for key.
+func (b SqlAuthBackend) SaveFailures(key string, r FailureRecord) error {
+	stmt := b.updateFailuresStmt
+	err := b.failuresStmt.QueryRow(key).Scan(new(int), new(int64), new(int64), new(int64))
+	if err == sql.ErrNoRows {
+		stmt = b.insertFailuresStmt
+	}
+	_, err = stmt.Exec(r.Count, unixNano(r.First), unixNano(r.Last), unixNano(r.LockedUntil), key)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// ResetFailures removes the login failure record for key.
+func (b SqlAuthBackend) ResetFailures(key string) error {
+	if _, err := b.resetFailuresStmt.Exec(key); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+const sessionColumns = `ID, Username, Created, LastSeen, Expires, IP, UserAgent, Data`
+
+// scanSession reads a row of sessionColumns.
+func scanSession(row interface{ Scan(...interface{}) error }) (r SessionRecord, e error) {
+	var created, seen, expires int64
+	err := row.Scan(&r.ID, &r.Username, &created, &seen, &expires, &r.IP, &r.UserAgent, &r.Data)
+	if err != nil {
+		return r, err
+	}
+	r.Created, r.LastSeen, r.Expires = fromUnixNano(created), fromUnixNano(seen), fromUnixNano(expires)
+	return r, nil
+}
+
+// Session returns the session record with the given ID.
+func (b SqlAuthBackend) Session(id string) (SessionRecord, error) {
+	r, err := scanSession(b.sessionStmt.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return r, ErrSessionNotFound
+	} else if err != nil {
+		return r, mksqlerror(err.Error())
+	}
+	return r, nil
+}
+
+// SaveSession adds or replaces a session record.
+func (b SqlAuthBackend) SaveSession(r SessionRecord) error {
+	stmt := b.updateSessionStmt
+	if _, err := b.Session(r.ID); err == ErrSessionNotFound {
+		stmt = b.insertSessionStmt
+	}
+	_, err := stmt.Exec(r.Username, unixNano(r.Created), unixNano(r.LastSeen), unixNano(r.Expires), r.IP, r.UserAgent, r.Data, r.ID)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteSession removes the session record with the given ID.
+func (b SqlAuthBackend) DeleteSession(id string) error {
+	if _, err := b.deleteSessionStmt.Exec(id); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// UserSessions returns all session records of username.
+func (b SqlAuthBackend) UserSessions(username string) (rs []SessionRecord, e error) {
+	rows, err := b.userSessionsStmt.Query(username)
+	if err != nil {
+		return rs, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanSession(rows)
+		if err != nil {
+			return rs, mksqlerror(err.Error())
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// DeleteUserSessions removes all session records of username.
+func (b SqlAuthBackend) DeleteUserSessions(username string) error {
+	if _, err := b.deleteUserSessionsStmt.Exec(username); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteExpiredSessions removes all session records that expired before the
+// given time.
+func (b SqlAuthBackend) DeleteExpiredSessions(before time.Time) error {
+	if _, err := b.deleteExpiredStmt.Exec(unixNano(before)); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// Roles returns all stored role definitions.
+func (b SqlAuthBackend) Roles() (rs []RoleDefinition, e error) {
+	rows, err := b.rolesStmt.Query()
+	if err != nil {
+		return rs, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r RoleDefinition
+		if err := rows.Scan(&r.Name, &r.Level, (*stringList)(&r.Permissions), (*stringList)(&r.Inherits)); err != nil {
+			return rs, mksqlerror(err.Error())
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// SaveRole adds or replaces a role definition.
+func (b SqlAuthBackend) SaveRole(r RoleDefinition) error {
+	stmt := b.updateRoleStmt
+	if err := b.roleStmt.QueryRow(r.Name).Scan(new(int)); err == sql.ErrNoRows {
+		stmt = b.insertRoleStmt
+	}
+	if _, err := stmt.Exec(r.Level, stringList(r.Permissions), stringList(r.Inherits), r.Name); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteRole removes a role definition.
+func (b SqlAuthBackend) DeleteRole(name string) error {
+	if _, err := b.deleteRoleStmt.Exec(name); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// Groups returns all stored group definitions.
+func (b SqlAuthBackend) Groups() (gs []GroupDefinition, e error) {
+	rows, err := b.groupsStmt.Query()
+	if err != nil {
+		return gs, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g GroupDefinition
+		if err := rows.Scan(&g.Name, (*stringList)(&g.Roles)); err != nil {
+			return gs, mksqlerror(err.Error())
+		}
+		gs = append(gs, g)
+	}
+	return gs, nil
+}
+
+// SaveGroup adds or replaces a group definition.
+func (b SqlAuthBackend) SaveGroup(g GroupDefinition) error {
+	stmt := b.updateGroupStmt
+	if err := b.groupStmt.QueryRow(g.Name).Scan(new(string)); err == sql.ErrNoRows {
+		stmt = b.insertGroupStmt
+	}
+	if _, err := stmt.Exec(stringList(g.Roles), g.Name); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteGroup removes a group definition.
+func (b SqlAuthBackend) DeleteGroup(name string) error {
+	if _, err := b.deleteGroupStmt.Exec(name); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// unixNano converts t for storage, mapping the zero time to 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano reverses unixNano.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
 // Close cleans up the backend by terminating the database connection.
 func (b SqlAuthBackend) Close() {
 	b.db.Close()
 	b.userStmt.Close()
 	b.usersStmt.Close()
+	b.emailStmt.Close()
 	b.insertStmt.Close()
 	b.updateStmt.Close()
 	b.deleteStmt.Close()
+	b.failuresStmt.Close()
+	b.insertFailuresStmt.Close()
+	b.updateFailuresStmt.Close()
+	b.resetFailuresStmt.Close()
+	b.sessionStmt.Close()
+	b.userSessionsStmt.Close()
+	b.insertSessionStmt.Close()
+	b.updateSessionStmt.Close()
+	b.deleteSessionStmt.Close()
+	b.deleteUserSessionsStmt.Close()
+	b.deleteExpiredStmt.Close()
+	b.rolesStmt.Close()
+	b.roleStmt.Close()
+	b.insertRoleStmt.Close()
+	b.updateRoleStmt.Close()
+	b.deleteRoleStmt.Close()
+	b.groupsStmt.Close()
+	b.groupStmt.Close()
+	b.insertGroupStmt.Close()
+	b.updateGroupStmt.Close()
+	b.deleteGroupStmt.Close()
 }
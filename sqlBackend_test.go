@@ -25,6 +25,10 @@ func testSqlInit(t *testing.T, driver string, info string) {
 		os.Exit(1)
 	}
 	con.Exec("drop table goauth")
+	con.Exec("drop table goauth_failures")
+	con.Exec("drop table goauth_sessions")
+	con.Exec("drop table goauth_roles")
+	con.Exec("drop table goauth_groups")
 }
 
 func testSqlBackend(t *testing.T, driver string, info string) {
@@ -63,6 +67,8 @@ func testSqlReopen(t *testing.T, driver string, info string) {
 	}
 
 	testAfterReopen(t, backend)
+	testFailuresAfterReopen(t, backend)
+	testSessionsAfterReopen(t, backend)
 }
 
 func sqlTests(t *testing.T, driver string, info string) {
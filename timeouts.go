@@ -0,0 +1,128 @@
+package httpauth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// ErrSessionExpired matches the *SessionExpiredError returned by Authorize for
+// sessions that ran into a timeout.
+var ErrSessionExpired = mkerror("session expired")
+
+// SessionExpiredError is returned by Authorize when a session has been idle
+// for too long or has reached its maximum lifetime. It matches
+// ErrSessionExpired.
+type SessionExpiredError struct {
+	Username string
+	Idle     bool // whether the idle timeout ran out, rather than the absolute one
+	At       time.Time
+}
+
+func (e *SessionExpiredError) Error() string {
+	kind := "absolute"
+	if e.Idle {
+		kind = "idle"
+	}
+	return "httpauth: session of " + e.Username + " expired (" + kind + " timeout) at " + e.At.Format(time.RFC3339)
+}
+
+// Is reports whether target is ErrSessionExpired.
+func (e *SessionExpiredError) Is(target error) bool {
+	return target == ErrSessionExpired
+}
+
+// SessionTimeouts limit how long a session stays logged in. Idle is the
+// longest allowed time between requests, Absolute the longest time since
+// logging in. Zero disables a limit.
+type SessionTimeouts struct {
+	Idle     time.Duration
+	Absolute time.Duration
+}
+
+// SetSessionTimeouts sets the timeouts of all sessions, with overrides for
+// sessions of users with some roles. If several of a user's roles have
+// overrides, the shortest of their limits apply. Sessions are checked and
+// their idle timer renewed by Authorize.
+func (a *Authorizer) SetSessionTimeouts(timeouts SessionTimeouts, roles map[string]SessionTimeouts) {
+	a.timeouts = timeouts
+	a.roleTimeouts = roles
+}
+
+// timeoutsFor returns the timeouts for sessions of user.
+func (a Authorizer) timeoutsFor(user UserData) SessionTimeouts {
+	if len(a.roleTimeouts) == 0 {
+		return a.timeouts
+	}
+	var (
+		t     SessionTimeouts
+		found bool
+	)
+	for _, role := range a.roles.userRoles(user) {
+		rt, ok := a.roleTimeouts[role]
+		if !ok {
+			continue
+		}
+		if !found {
+			t, found = rt, true
+			continue
+		}
+		t.Idle = stricter(t.Idle, rt.Idle)
+		t.Absolute = stricter(t.Absolute, rt.Absolute)
+	}
+	if !found {
+		return a.timeouts
+	}
+	return t
+}
+
+// stricter returns the shorter of two limits, where zero means no limit.
+func stricter(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// stampSession records the start of a session.
+func stampSession(session *sessions.Session, now time.Time) {
+	session.Values["issued"] = now.Unix()
+	session.Values["seen"] = now.Unix()
+}
+
+// checkTimeouts returns a *SessionExpiredError if session has timed out, and
+// otherwise renews its idle timer. Sessions from before timeouts were enabled
+// are treated as if they just started.
+func (a Authorizer) checkTimeouts(rw http.ResponseWriter, req *http.Request, session *sessions.Session, user UserData) error {
+	t := a.timeoutsFor(user)
+	if t.Idle == 0 && t.Absolute == 0 {
+		return nil
+	}
+	now := time.Now()
+	issuedAt, ok := session.Values["issued"].(int64)
+	seenAt, _ := session.Values["seen"].(int64)
+	if !ok {
+		stampSession(session, now)
+		session.Save(req, rw)
+		return nil
+	}
+	issued, seen := time.Unix(issuedAt, 0), time.Unix(seenAt, 0)
+	if t.Absolute > 0 && now.After(issued.Add(t.Absolute)) {
+		return &SessionExpiredError{user.Username, false, issued.Add(t.Absolute)}
+	}
+	if t.Idle > 0 && now.After(seen.Add(t.Idle)) {
+		return &SessionExpiredError{user.Username, true, seen.Add(t.Idle)}
+	}
+	// Renew at most once a minute, or more often for short idle timeouts, to
+	// avoid writing the session on every request.
+	renew := t.Idle / 10
+	if renew > sessionTouchInterval {
+		renew = sessionTouchInterval
+	}
+	if t.Idle > 0 && now.Sub(seen) >= renew {
+		session.Values["seen"] = now.Unix()
+		session.Save(req, rw)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// ageSession moves the login and last request of a session back in time.
+func ageSession(t *testing.T, auth Authorizer, cookies []*http.Cookie, issued time.Duration, seen time.Duration) []*http.Cookie {
+	req := newTestRequest("GET", cookies)
+	session, err := auth.authSession(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["issued"] = time.Now().Add(-issued).Unix()
+	session.Values["seen"] = time.Now().Add(-seen).Unix()
+	rw := httptest.NewRecorder()
+	if err := session.Save(req, rw); err != nil {
+		t.Fatal(err)
+	}
+	return rw.Result().Cookies()
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetSessionTimeouts(SessionTimeouts{Idle: 30 * time.Minute, Absolute: 12 * time.Hour},
+		map[string]SessionTimeouts{"admin": {Idle: 5 * time.Minute}})
+	cookies := loginCookies(t, auth, "user")
+	admin := loginCookies(t, auth, "admin")
+
+	for _, c := range []struct {
+		cookies      []*http.Cookie
+		issued, seen time.Duration
+		expired      bool
+		idle         bool
+	}{
+		{cookies, 11 * time.Hour, 29 * time.Minute, false, false},
+		{cookies, 13 * time.Hour, time.Minute, true, false},
+		{cookies, time.Hour, 31 * time.Minute, true, true},
+		{admin, 13 * time.Hour, 4 * time.Minute, false, false},
+		{admin, time.Hour, 6 * time.Minute, true, true},
+	} {
+		aged := ageSession(t, auth, c.cookies, c.issued, c.seen)
+		err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", aged), false)
+		var expErr *SessionExpiredError
+		if !c.expired {
+			if err != nil {
+				t.Errorf("Authorize after %v/%v: %v", c.issued, c.seen, err)
+			}
+		} else if !errors.Is(err, ErrSessionExpired) || !errors.As(err, &expErr) || expErr.Idle != c.idle {
+			t.Errorf("Authorize after %v/%v: expected idle=%v SessionExpiredError, got %v", c.issued, c.seen, c.idle, err)
+		}
+	}
+}
+
+func TestSessionIdleRenewal(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.SetSessionTimeouts(SessionTimeouts{Idle: 30 * time.Minute}, nil)
+	aged := ageSession(t, auth, loginCookies(t, auth, "user"), 0, 20*time.Minute)
+
+	rw := httptest.NewRecorder()
+	if err := auth.Authorize(rw, newTestRequest("GET", aged), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	renewed := rw.Result().Cookies()
+	if len(renewed) == 0 {
+		t.Fatal("Authorize: session not renewed")
+	}
+	session, _ := auth.authSession(newTestRequest("GET", renewed))
+	if seen, _ := session.Values["seen"].(int64); time.Since(time.Unix(seen, 0)) > time.Minute {
+		t.Fatal("Authorize: last activity not updated")
+	}
+}
+
+func TestSessionTimeoutsMultipleRoles(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	auth.AddRole("support", 30)
+	auth.SetSessionTimeouts(SessionTimeouts{Idle: time.Hour},
+		map[string]SessionTimeouts{"admin": {Idle: 5 * time.Minute}, "support": {Idle: 10 * time.Minute, Absolute: time.Hour}})
+	auth.SetUserRoles(httptest.NewRecorder(), newTestRequest("POST", nil), "user", "user", "support", "admin")
+	user, _ := auth.backend.User("user")
+	if got, want := auth.timeoutsFor(user), (SessionTimeouts{Idle: 5 * time.Minute, Absolute: time.Hour}); got != want {
+		t.Fatalf("timeoutsFor: expected %+v, got %+v", want, got)
+	}
+}
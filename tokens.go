@@ -0,0 +1,64 @@
+package httpauth
+
+import (
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// ErrInvalidToken is returned when a token from an email link is malformed,
+// has a bad signature, or no longer matches the account it was issued for.
+// ErrTokenExpired is returned when a token is used after it expired.
+var (
+	ErrInvalidToken = mkerror("invalid token")
+	ErrTokenExpired = mkerror("token expired")
+)
+
+// Token purposes, which are part of each token's signature.
+const (
+	tokenVerifyEmail   = "verify-email"
+	tokenResetPassword = "reset-password"
+	tokenLogin         = "login"
+)
+
+// token is the signed payload of the tokens sent in email links. Check ties a
+// token to the state of the account it was issued for, so that it stops
+// working once that state changes.
+type token struct {
+	Username string
+	Check    string
+	Expires  int64
+}
+
+// tokenCodecs returns the codecs used to sign, and optionally encrypt, tokens
+// with the given hash and block key pairs. Expiry is checked by parseToken,
+// since lifetimes differ by purpose.
+func tokenCodecs(keyPairs ...[]byte) []securecookie.Codec {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if s, ok := c.(*securecookie.SecureCookie); ok {
+			s.MaxAge(0)
+		}
+	}
+	return codecs
+}
+
+// signToken returns a URL safe token for purpose, valid for ttl. The purpose
+// is part of the signature, so a token can't be used for anything else.
+func (a Authorizer) signToken(purpose string, username string, check string, ttl time.Duration) (string, error) {
+	t := token{Username: username, Check: check, Expires: time.Now().Add(ttl).Unix()}
+	return securecookie.EncodeMulti(purpose, t, a.tokens...)
+}
+
+// parseToken checks the signature and expiry of a token made by signToken for
+// purpose.
+func (a Authorizer) parseToken(purpose string, s string) (token, error) {
+	var t token
+	if err := securecookie.DecodeMulti(purpose, s, &t, a.tokens...); err != nil {
+		return t, ErrInvalidToken
+	}
+	if time.Now().Unix() > t.Expires {
+		return t, ErrTokenExpired
+	}
+	return t, nil
+}
@@ -0,0 +1,257 @@
+package httpauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// ErrSecondFactorRequired is returned by Login when the password was correct
+// but the user has two factor authentication enabled. Finish logging in with
+// VerifySecondFactor.
+// ErrInvalidCode is returned when a second factor code doesn't match.
+// ErrTOTPNotEnrolled is returned when confirming, disabling or verifying a
+// code for a user without a TOTP secret.
+// ErrTOTPEnabled is returned by EnrollTOTP if the user already has two factor
+// authentication enabled.
+var (
+	ErrSecondFactorRequired = mkerror("second factor required")
+	ErrInvalidCode          = mkerror("invalid second factor code")
+	ErrTOTPNotEnrolled      = mkerror("two factor authentication not set up")
+	ErrTOTPEnabled          = mkerror("two factor authentication already enabled")
+)
+
+const (
+	totpPeriod = 30 // seconds
+	totpDigits = 6
+	totpSkew   = 1 // periods before and after the current one that are accepted
+
+	// How long a half authenticated session waits for its second factor, and
+	// how many wrong codes in a row lock the second factor for as long.
+	pendingLoginTimeout  = 5 * time.Minute
+	pendingLoginAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code for secret at the given time step.
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStep returns the time step at which code is valid for the base32
+// encoded secret around time t, allowing for some clock skew, or -1 if it
+// isn't valid.
+func totpStep(secret string, code string, t time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	counter := t.Unix() / totpPeriod
+	step := int64(-1)
+	for i := counter - totpSkew; i <= counter+totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(i))), []byte(code)) == 1 {
+			step = i
+		}
+	}
+	return step
+}
+
+// useTOTPCode reports whether code is a valid TOTP code for user that is newer
+// than the last one they used, recording it as used if so. Codes can't be
+// replayed, as RFC 6238 section 5.2 requires.
+func useTOTPCode(user *UserData, code string) bool {
+	if user.TOTPSecret == "" {
+		return false
+	}
+	step := totpStep(user.TOTPSecret, code, time.Now())
+	if step < 0 || step <= user.TOTPLastStep {
+		return false
+	}
+	user.TOTPLastStep = step
+	return true
+}
+
+// TOTPURI returns an otpauth:// URI for a TOTP secret, suitable for encoding
+// in a QR code for authenticator apps.
+func TOTPURI(issuer string, username string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// EnrollTOTP starts setting up two factor authentication for the logged in
+// user. It generates and saves a new TOTP secret, returning it along with an
+// otpauth:// URI for authenticator apps. Two factor authentication isn't
+// enabled until the user proves their app works with ConfirmTOTP.
+func (a Authorizer) EnrollTOTP(rw http.ResponseWriter, req *http.Request, issuer string) (secret string, uri string, e error) {
+	user, err := a.currentUserForUpdate(rw, req)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", ErrTOTPEnabled
+	}
+	key, err := randomBytes(20)
+	if err != nil {
+		return "", "", err
+	}
+	user.TOTPSecret = totpEncoding.EncodeToString(key)
+	if err := a.saveCurrentUser(user); err != nil {
+		return "", "", err
+	}
+	return user.TOTPSecret, TOTPURI(issuer, user.Username, user.TOTPSecret), nil
+}
+
+// ConfirmTOTP enables two factor authentication for the logged in user if code
+// is valid for the secret from EnrollTOTP.
+func (a Authorizer) ConfirmTOTP(rw http.ResponseWriter, req *http.Request, code string) error {
+	user, err := a.currentUserForUpdate(rw, req)
+	if err != nil {
+		return err
+	}
+	if user.TOTPSecret == "" {
+		return ErrTOTPNotEnrolled
+	}
+	if !useTOTPCode(&user, code) {
+		return ErrInvalidCode
+	}
+	user.TOTPEnabled = true
+	return a.saveCurrentUser(user)
+}
+
+// DisableTOTP turns off two factor authentication for the logged in user and
+// removes their recovery codes. A valid TOTP code or an unused recovery code
+// is required, so that users who lost their authenticator app can start over
+// with EnrollTOTP.
+func (a Authorizer) DisableTOTP(rw http.ResponseWriter, req *http.Request, code string) error {
+	user, err := a.currentUserForUpdate(rw, req)
+	if err != nil {
+		return err
+	}
+	if user.TOTPSecret == "" {
+		return ErrTOTPNotEnrolled
+	}
+	if !useTOTPCode(&user, code) && !useRecoveryCode(&user, code) {
+		return ErrInvalidCode
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.RecoveryCodes = nil
+	return a.saveCurrentUser(user)
+}
+
+// VerifySecondFactor finishes a login that Login answered with
+// ErrSecondFactorRequired. If code is a valid TOTP code or an unused recovery
+// code, the user is logged in and redirected like Login would have. The half
+// authenticated session expires after five minutes, after which the user has
+// to log in again. After five wrong codes in a row, the user's second factor
+// is locked for five minutes, returning a *LockoutError; wrong codes are
+// counted with the user, so starting a new login doesn't reset them.
+func (a Authorizer) VerifySecondFactor(rw http.ResponseWriter, req *http.Request, code string, dest string) error {
+	session, _ := a.authSession(req)
+	username, ok := session.Values["pending"].(string)
+	started, _ := session.Values["pending_at"].(int64)
+	if !ok || time.Since(time.Unix(started, 0)) > pendingLoginTimeout {
+		a.clearPending(rw, req, session)
+		a.fail(rw, req, http.StatusUnauthorized, CodeNotLoggedIn, "Log in to do that.")
+		return ErrNotLoggedIn
+	}
+	if err := a.checkLockout(req, username); err != nil {
+		a.reportLockout(rw, req, err)
+		return err
+	}
+	// Check one code of the user's at a time, so concurrent guesses can't
+	// overwrite each other's failure counts or use the same code twice.
+	unlock := a.locks.lock("2fa:" + username)
+	defer unlock()
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		a.clearPending(rw, req, session)
+		return ErrUserNotFound
+	} else if err != nil {
+		a.backendFailure(rw, err)
+		return backendError(err)
+	}
+	now := time.Now()
+	lastFailure := time.Unix(user.SecondFactorFailedAt, 0)
+	if now.Sub(lastFailure) > pendingLoginTimeout {
+		user.SecondFactorFailures = 0
+	} else if user.SecondFactorFailures >= pendingLoginAttempts {
+		a.clearPending(rw, req, session)
+		err := &LockoutError{Username: username, Until: lastFailure.Add(pendingLoginTimeout)}
+		a.reportLockout(rw, req, err)
+		return err
+	}
+	valid := useTOTPCode(&user, code) || useRecoveryCode(&user, code)
+	if valid {
+		user.SecondFactorFailures = 0
+	} else {
+		user.SecondFactorFailures++
+		user.SecondFactorFailedAt = now.Unix()
+	}
+	if err := a.backend.SaveUser(user); err != nil {
+		a.backendFailure(rw, err)
+		return backendError(err)
+	}
+	if !valid {
+		a.recordFailure(req, username, ErrInvalidCode)
+		if user.SecondFactorFailures >= pendingLoginAttempts {
+			a.clearPending(rw, req, session)
+		}
+		a.fail(rw, req, http.StatusUnauthorized, CodeInvalidCode, "Invalid code.")
+		return ErrInvalidCode
+	}
+	a.resetFailures(username)
+	a.finishLogin(rw, req, session, user, dest)
+	return nil
+}
+
+// startPendingLogin saves a half authenticated session for username, which
+// VerifySecondFactor turns into a full one.
+func (a Authorizer) startPendingLogin(rw http.ResponseWriter, req *http.Request, session *sessions.Session, username string) {
+	a.regenerateSession(session)
+	session.Values["pending"] = username
+	session.Values["pending_at"] = time.Now().Unix()
+	session.Save(req, rw)
+}
+
+// clearPending ends a half authenticated session.
+func (a Authorizer) clearPending(rw http.ResponseWriter, req *http.Request, session *sessions.Session) {
+	deletePending(session)
+	session.Save(req, rw)
+}
+
+func deletePending(session *sessions.Session) {
+	delete(session.Values, "pending")
+	delete(session.Values, "pending_at")
+}
+
+// saveCurrentUser saves changes to the logged in user.
+func (a Authorizer) saveCurrentUser(user UserData) error {
+	if err := a.backend.SaveUser(user); err != nil {
+		return backendError(err)
+	}
+	return nil
+}
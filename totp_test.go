@@ -0,0 +1,208 @@
+package httpauth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	} {
+		if c := totpCode(secret, uint64(unix/totpPeriod)); c != code {
+			t.Errorf("totpCode at %d: expected %v, got %v", unix, code, c)
+		}
+	}
+}
+
+func currentTOTP(t *testing.T, secret string) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, uint64(time.Now().Unix()/totpPeriod))
+}
+
+// nextTOTP returns a current code for username, first forgetting the last
+// code they used as if its time step had passed.
+func nextTOTP(t *testing.T, auth Authorizer, username string, secret string) string {
+	user, err := auth.backend.User(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.TOTPLastStep = 0
+	if err := auth.backend.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return currentTOTP(t, secret)
+}
+
+// enableTOTP sets up two factor authentication for a user, returning the
+// secret and the cookies of a session that was logged in beforehand.
+func enableTOTP(t *testing.T, auth Authorizer, username string) (string, []*http.Cookie) {
+	cookies := loginCookies(t, auth, username)
+	secret, uri, err := auth.EnrollTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), "Example")
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "otpauth" || u.Host != "totp" || u.Query().Get("secret") != secret {
+		t.Fatalf("EnrollTOTP: invalid URI %v", uri)
+	}
+	if !strings.HasSuffix(u.Path, "Example:"+username) {
+		t.Fatalf("EnrollTOTP: wrong label in %v", uri)
+	}
+	err = auth.ConfirmTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), "000000")
+	if !errors.Is(err, ErrInvalidCode) && currentTOTP(t, secret) != "000000" {
+		t.Fatalf("ConfirmTOTP: expected ErrInvalidCode, got %v", err)
+	}
+	if err := auth.ConfirmTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), currentTOTP(t, secret)); err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	return secret, cookies
+}
+
+func TestTOTPLogin(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	secret, _ := enableTOTP(t, auth, "user")
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	if err := auth.Login(rw, req, "user", "password", "/"); !errors.Is(err, ErrSecondFactorRequired) {
+		t.Fatalf("Login: expected ErrSecondFactorRequired, got %v", err)
+	}
+	if loc := rw.Header().Get("Location"); loc != "" {
+		t.Fatalf("Login: redirected to %v before second factor", loc)
+	}
+	pending := rw.Result().Cookies()
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", pending), false); err == nil {
+		t.Fatal("Authorize: half authenticated session accepted")
+	}
+
+	rw = httptest.NewRecorder()
+	err := auth.VerifySecondFactor(rw, newTestRequest("POST", pending), "abcdef", "/")
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("VerifySecondFactor: expected ErrInvalidCode, got %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	code := nextTOTP(t, auth, "user", secret)
+	if err := auth.VerifySecondFactor(rw, newTestRequest("POST", pending), code, "/"); err != nil {
+		t.Fatalf("VerifySecondFactor: %v", err)
+	}
+	if loc := rw.Header().Get("Location"); loc != "/" {
+		t.Fatalf("VerifySecondFactor: expected redirect to /, got %v", loc)
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), newTestRequest("GET", rw.Result().Cookies()), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	// Without a pending login, codes are useless.
+	err = auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", nil), code, "/")
+	if !errors.Is(err, ErrNotLoggedIn) {
+		t.Fatalf("VerifySecondFactor: expected ErrNotLoggedIn, got %v", err)
+	}
+
+	// Codes can't be used twice.
+	rw = httptest.NewRecorder()
+	auth.Login(rw, req, "user", "password", "/")
+	err = auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", rw.Result().Cookies()), code, "/")
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("VerifySecondFactor: expected ErrInvalidCode for reused code, got %v", err)
+	}
+}
+
+func TestTOTPPendingAttempts(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	secret, _ := enableTOTP(t, auth, "user")
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	auth.Login(rw, req, "user", "password", "")
+	pending := rw.Result().Cookies()
+	for i := 0; i < pendingLoginAttempts; i++ {
+		// Replaying the original cookie doesn't reset the count.
+		auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pending), "abcdef", "")
+	}
+	code := nextTOTP(t, auth, "user", secret)
+	err := auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pending), code, "")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("VerifySecondFactor: expected ErrAccountLocked after too many attempts, got %v", err)
+	}
+
+	// Neither does logging in again.
+	rw = httptest.NewRecorder()
+	auth.Login(rw, req, "user", "password", "")
+	err = auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", rw.Result().Cookies()), code, "")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("VerifySecondFactor: expected ErrAccountLocked after new login, got %v", err)
+	}
+}
+
+// slowBackend delays returning users, so that concurrent updates of a user
+// overlap.
+type slowBackend struct {
+	AuthBackend
+}
+
+func (b slowBackend) User(username string) (UserData, error) {
+	user, err := b.AuthBackend.User(username)
+	time.Sleep(10 * time.Millisecond)
+	return user, err
+}
+
+func TestConcurrentSecondFactor(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	enableTOTP(t, auth, "user")
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	auth.Login(rw, req, "user", "password", "")
+	pending := rw.Result().Cookies()
+	auth.backend = slowBackend{auth.backend}
+	var wg sync.WaitGroup
+	for i := 0; i < pendingLoginAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			auth.VerifySecondFactor(httptest.NewRecorder(), newTestRequest("POST", pending), "abcdef", "")
+		}()
+	}
+	wg.Wait()
+	user, err := auth.backend.User("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.SecondFactorFailures != pendingLoginAttempts {
+		t.Fatalf("Expected %d failures, got %d", pendingLoginAttempts, user.SecondFactorFailures)
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	auth := newTestAuthorizer(t)
+	secret, _ := enableTOTP(t, auth, "user")
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	auth.Login(rw, req, "user", "password", "")
+	rw2 := httptest.NewRecorder()
+	if err := auth.VerifySecondFactor(rw2, newTestRequest("POST", rw.Result().Cookies()), nextTOTP(t, auth, "user", secret), ""); err != nil {
+		t.Fatalf("VerifySecondFactor: %v", err)
+	}
+	cookies := rw2.Result().Cookies()
+	if err := auth.DisableTOTP(httptest.NewRecorder(), newTestRequest("POST", cookies), nextTOTP(t, auth, "user", secret)); err != nil {
+		t.Fatalf("DisableTOTP: %v", err)
+	}
+	loginCookies(t, auth, "user")
+}